@@ -0,0 +1,510 @@
+package server
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	pathpkg "path"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+/*
+Folders can be downloaded and uploaded whole as tar, gzipped tar or zip
+archives. Entries are named relative to the folder. Modes and modification
+times travel in the archive's own headers, and the author and description of
+each image in PAX records for tars or the file comment for zips, so an
+archive downloaded from one tree recreates the same images in another.
+Uploads are extracted in a single Raft command, so either every entry
+appears or none do.
+*/
+
+const (
+	maxArchiveEntries = 10000
+	paxAuthor         = "VORTEIL.author"
+	paxDescription    = "VORTEIL.description"
+)
+
+var (
+	ResponseBadArchive = NewFailResponse(0, "bad archive")
+
+	errBadArchive = errors.New("bad archive")
+)
+
+var archiveTypes = map[string]string{
+	"tar":    "application/x-tar",
+	"tar.gz": "application/gzip",
+	"zip":    "application/zip",
+}
+
+// archiveEntry is a folder or image unpacked from an uploaded archive. Path
+// is relative to the folder the archive is extracted into.
+type archiveEntry struct {
+	Path        string
+	Type        string
+	Mode        uint16
+	Author      string
+	Description string
+	Time        uint64
+	Checksum    string
+	Size        int64
+	Meta        *blobMeta
+}
+
+type archiveArgs struct {
+	Owner   string
+	Group   string
+	Mode    uint16
+	Target  string
+	Parents bool
+	Node    string
+	Entries []archiveEntry
+}
+
+// zipAttrs is stored as the comment of each zip entry.
+type zipAttrs struct {
+	Author      string `json:"author,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+func (i *Images) extractFSM(data []byte) interface{} {
+	args := new(archiveArgs)
+	ret := new(uploadRet)
+	err := decode(data, args)
+	if err != nil {
+		return ret
+	}
+	err = i.s.data.imagesExtract(args)
+	ret.Ok = err == nil
+	ret.Quota = err == errQuotaExceeded
+	return ret
+}
+
+// downloadArchive streams every readable folder and image beneath a folder
+// as an archive. Images in protected folders that lack a trusted signature
+// are left out.
+func (i *Images) downloadArchive(s *Session, w http.ResponseWriter, r *http.Request) {
+	format := mux.Vars(r)["format"]
+	contentType, ok := archiveTypes[format]
+	if !ok {
+		w.Write(ResponseBadArchive.JSON())
+		return
+	}
+	target := i.target(r)
+	if !strings.HasPrefix(target+"/", "/images/") {
+		w.Write(ResponseAccessDenied.JSON())
+		return
+	}
+	path, name := splitPath(target)
+	chk, err := i.s.data.imagesGetInfo(path, name)
+	if err != nil {
+		w.Write(NewFailResponse(0, "no such file").JSON())
+		return
+	}
+	if chk != "folder" {
+		w.Write(ResponseNotFolder.JSON())
+		return
+	}
+
+	nodes, err := i.s.data.imagesArchive(path, name)
+	if err != nil {
+		panic(err)
+	}
+	var entries []archiveNode
+	for _, n := range nodes {
+		full := n.Path + "/" + n.Name
+		if full == target || !i.s.CanReadFile(s, full) {
+			continue
+		}
+		if n.Type == "file" && i.s.data.imagesProtected(full) && !i.verified(full, n.Checksum) {
+			continue
+		}
+		entries = append(entries, n)
+	}
+	// once the headers are written a missing blob can only truncate the
+	// archive, so make sure this node has them all first
+	for _, n := range entries {
+		if n.Type == "file" && !i.holds(n.Checksum) {
+			w.Write(ResponseNotReplicated.JSON())
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+name+"."+format+"\"")
+	aw := newArchiveWriter(format, w)
+	for _, n := range entries {
+		err = i.writeArchiveEntry(aw, strings.TrimPrefix(n.Path+"/"+n.Name, target+"/"), &n)
+		if err != nil {
+			// the response is already under way, so the best we can do is
+			// leave the archive truncated
+			i.log.Error("couldn't write archive", "folder", target, "error", err)
+			return
+		}
+	}
+	err = aw.Close()
+	if err != nil {
+		i.log.Error("couldn't write archive", "folder", target, "error", err)
+	}
+}
+
+func (i *Images) writeArchiveEntry(aw archiveWriter, rel string, n *archiveNode) error {
+	if n.Type == "folder" {
+		return aw.folder(rel, n)
+	}
+	file, err := i.storage().Get(n.Checksum)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	size, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	return aw.file(rel, n, size, file)
+}
+
+// uploadArchive extracts an archive into a folder, creating the folder if
+// it doesn't exist. Every image is put in storage first and the whole tree
+// is then committed in one command. Entries that clash with existing images
+// fail the upload.
+func (i *Images) uploadArchive(s *Session, w http.ResponseWriter, r *http.Request) {
+	format := mux.Vars(r)["format"]
+	if _, ok := archiveTypes[format]; !ok {
+		w.Write(ResponseBadArchive.JSON())
+		return
+	}
+	target := i.target(r)
+	if !strings.HasPrefix(target, "/images/") {
+		w.Write(ResponseAccessDenied.JSON())
+		return
+	}
+	if chk, err := i.s.data.imagesGetInfo(splitPath(target)); err == nil {
+		if chk != "folder" {
+			w.Write(ResponseNotFolder.JSON())
+			return
+		}
+		if !i.s.CanWriteFile(s, target) {
+			w.Write(ResponseAccessDenied.JSON())
+			return
+		}
+	}
+	args := &archiveArgs{
+		Owner:   s.User.Name(),
+		Group:   s.User.PrimaryGroup(),
+		Mode:    s.Mode(),
+		Target:  target,
+		Parents: r.URL.Query().Get("parents") == "true",
+		Node:    i.s.conf.Advertise,
+	}
+	if !i.s.data.quotaAllows(args.Owner, args.Group, r.ContentLength) {
+		w.Write(ResponseQuotaExceeded.JSON())
+		return
+	}
+
+	err := i.readArchive(format, r.Body, args.Mode, func(e *archiveEntry, data io.Reader) error {
+		if len(args.Entries) >= maxArchiveEntries {
+			return errBadArchive
+		}
+		full := target + "/" + e.Path
+		if !i.s.CanWriteFile(s, i.s.data.existingAncestor(full)) {
+			return errAccessDenied
+		}
+		if e.Type == "file" {
+			tmp, sums, err := i.stage(data)
+			if err != nil {
+				return err
+			}
+			e.Checksum = sums.checksum()
+			e.Size = sums.size
+			e.Meta = detectFormat(tmp, sums.size)
+			err = i.store(tmp, e.Checksum)
+			if err != nil {
+				return err
+			}
+		}
+		args.Entries = append(args.Entries, *e)
+		return nil
+	})
+	release := func() {
+		for _, e := range args.Entries {
+			if e.Type == "file" {
+				i.release(e.Checksum)
+			}
+		}
+	}
+	if err != nil {
+		release()
+		if err == errAccessDenied {
+			w.Write(ResponseAccessDenied.JSON())
+			return
+		}
+		i.log.Debug("couldn't read uploaded archive", "folder", target, "error", err)
+		w.Write(ResponseBadArchive.JSON())
+		return
+	}
+
+	ret := i.s.sync("imagesExtract", args)
+	x, ok := ret.(*uploadRet)
+	if !ok || !x.Ok {
+		release()
+		if ok && x.Quota {
+			w.Write(ResponseQuotaExceeded.JSON())
+			return
+		}
+		w.Write(NewFailResponse(0, "couldn't extract archive").JSON())
+		return
+	}
+	i.warnQuotas(args.Owner, args.Group)
+	w.Write(NewSuccessResponse(nil).JSON())
+}
+
+// readArchive calls fn for every folder and regular file in an archive, in
+// the order they appear. Other kinds of entry are skipped. Names are cleaned
+// so that nothing can be extracted outside the target folder, and entries
+// without a mode get mode.
+func (i *Images) readArchive(format string, body io.Reader, mode uint16, fn func(*archiveEntry, io.Reader) error) error {
+	if format == "zip" {
+		return i.readZip(body, mode, fn)
+	}
+	if format == "tar.gz" {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		body = gz
+	}
+
+	tr := tar.NewReader(body)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		e := &archiveEntry{
+			Path:        cleanArchivePath(hdr.Name),
+			Mode:        uint16(hdr.Mode & 0777),
+			Author:      hdr.PAXRecords[paxAuthor],
+			Description: hdr.PAXRecords[paxDescription],
+			Time:        archiveTime(hdr.ModTime),
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			e.Type = "folder"
+		case tar.TypeReg, tar.TypeRegA:
+			e.Type = "file"
+		default:
+			continue
+		}
+		if e.Path == "" {
+			continue
+		}
+		if e.Mode == 0 {
+			e.Mode = mode
+		}
+		err = fn(e, tr)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// readZip stages a zip archive to disk first, since its directory is at the
+// end of the file.
+func (i *Images) readZip(body io.Reader, mode uint16, fn func(*archiveEntry, io.Reader) error) error {
+	tmp, sums, err := i.stage(body)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	file, err := os.Open(tmp)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	zr, err := zip.NewReader(file, sums.size)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range zr.File {
+		e := &archiveEntry{
+			Path: cleanArchivePath(f.Name),
+			Mode: uint16(f.Mode().Perm()),
+			Time: archiveTime(f.Modified),
+		}
+		var attrs zipAttrs
+		if json.Unmarshal([]byte(f.Comment), &attrs) == nil {
+			e.Author = attrs.Author
+			e.Description = attrs.Description
+		}
+		switch {
+		case f.Mode().IsDir():
+			e.Type = "folder"
+		case f.Mode().IsRegular():
+			e.Type = "file"
+		default:
+			continue
+		}
+		if e.Path == "" {
+			continue
+		}
+		if e.Mode == 0 {
+			e.Mode = mode
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		err = fn(e, rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func cleanArchivePath(name string) string {
+	return strings.TrimPrefix(pathpkg.Clean("/"+name), "/")
+}
+
+func archiveTime(t time.Time) uint64 {
+	if t.IsZero() || t.Unix() <= 0 {
+		return 0
+	}
+	return uint64(t.Unix())
+}
+
+func archiveModTime(date uint64) time.Time {
+	if date == 0 {
+		return time.Now()
+	}
+	return time.Unix(int64(date), 0)
+}
+
+type archiveWriter interface {
+	folder(rel string, n *archiveNode) error
+	file(rel string, n *archiveNode, size int64, data io.Reader) error
+	Close() error
+}
+
+func newArchiveWriter(format string, w io.Writer) archiveWriter {
+	switch format {
+	case "zip":
+		return &zipWriter{zip.NewWriter(w)}
+	case "tar.gz":
+		gz := gzip.NewWriter(w)
+		return &tarWriter{tar.NewWriter(gz), gz}
+	default:
+		return &tarWriter{tar.NewWriter(w), nil}
+	}
+}
+
+type tarWriter struct {
+	tw *tar.Writer
+	gz *gzip.Writer
+}
+
+func (t *tarWriter) header(rel string, n *archiveNode) *tar.Header {
+	hdr := &tar.Header{
+		Name:    rel,
+		Mode:    int64(n.Rules.Mode),
+		Uname:   n.Rules.Owner,
+		Gname:   n.Rules.Group,
+		ModTime: archiveModTime(n.Time),
+		Format:  tar.FormatPAX,
+	}
+	if n.Author != "" || n.Description != "" {
+		hdr.PAXRecords = make(map[string]string)
+		if n.Author != "" {
+			hdr.PAXRecords[paxAuthor] = n.Author
+		}
+		if n.Description != "" {
+			hdr.PAXRecords[paxDescription] = n.Description
+		}
+	}
+	return hdr
+}
+
+func (t *tarWriter) folder(rel string, n *archiveNode) error {
+	hdr := t.header(rel+"/", n)
+	hdr.Typeflag = tar.TypeDir
+	return t.tw.WriteHeader(hdr)
+}
+
+func (t *tarWriter) file(rel string, n *archiveNode, size int64, data io.Reader) error {
+	hdr := t.header(rel, n)
+	hdr.Typeflag = tar.TypeReg
+	hdr.Size = size
+	err := t.tw.WriteHeader(hdr)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(t.tw, data)
+	return err
+}
+
+func (t *tarWriter) Close() error {
+	err := t.tw.Close()
+	if err != nil || t.gz == nil {
+		return err
+	}
+	return t.gz.Close()
+}
+
+type zipWriter struct {
+	zw *zip.Writer
+}
+
+func (z *zipWriter) header(rel string, n *archiveNode, mode os.FileMode) *zip.FileHeader {
+	hdr := &zip.FileHeader{
+		Name:     rel,
+		Method:   zip.Deflate,
+		Modified: archiveModTime(n.Time),
+	}
+	hdr.SetMode(mode | os.FileMode(n.Rules.Mode))
+	if n.Author != "" || n.Description != "" {
+		comment, err := json.Marshal(&zipAttrs{n.Author, n.Description})
+		if err != nil {
+			panic(err)
+		}
+		hdr.Comment = string(comment)
+	}
+	return hdr
+}
+
+func (z *zipWriter) folder(rel string, n *archiveNode) error {
+	hdr := z.header(rel+"/", n, os.ModeDir)
+	hdr.Method = zip.Store
+	_, err := z.zw.CreateHeader(hdr)
+	return err
+}
+
+func (z *zipWriter) file(rel string, n *archiveNode, size int64, data io.Reader) error {
+	f, err := z.zw.CreateHeader(z.header(rel, n, 0))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, data)
+	return err
+}
+
+func (z *zipWriter) Close() error {
+	return z.zw.Close()
+}
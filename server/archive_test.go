@@ -0,0 +1,42 @@
+package server
+
+import (
+	"testing"
+)
+
+func TestExtractFolderModes(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+	testInsert(t, s, "folder", "/images", "x", &Rules{Owner: "alice", Group: "dev", Mode: 0755})
+	testInsert(t, s, "folder", "/images/x", "keep", &Rules{Owner: "alice", Group: "dev", Mode: 0755})
+
+	err := s.data.imagesExtract(&archiveArgs{
+		Owner:  "alice",
+		Group:  "dev",
+		Mode:   0750,
+		Target: "/images/x",
+		Entries: []archiveEntry{
+			{Path: "a/b/f", Type: "file", Mode: 0600, Checksum: sha256Hex("f")},
+			{Path: "a", Type: "folder", Mode: 0700},
+			{Path: "keep", Type: "folder", Mode: 0700},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for target, want := range map[string]uint16{
+		"/images/x/a":     0700,
+		"/images/x/a/b":   0750,
+		"/images/x/a/b/f": 0600,
+		"/images/x/keep":  0755,
+	} {
+		r, err := s.data.getRules(splitPath(target))
+		if err != nil {
+			t.Fatalf("%s: %v", target, err)
+		}
+		if r.Mode != want {
+			t.Errorf("%s has mode %o, want %o", target, r.Mode, want)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+const (
+	reserveAttempts = 10
+	reserveBackoff  = 500 * time.Millisecond
+)
+
+var errBlobBusy = errors.New("blob is being removed from storage")
+
+type blobArgs struct {
+	Checksum string
+	Size     int64
+}
+
+type blobRet struct {
+	Ok     bool
+	Stored bool
+	Dead   bool
+}
+
+func (i *Images) blobReserveFSM(data []byte) interface{} {
+	args := new(blobArgs)
+	ret := new(blobRet)
+	err := decode(data, args)
+	if err != nil {
+		return ret
+	}
+	ret.Ok, ret.Stored = i.s.data.blobsReserve(args.Checksum)
+	return ret
+}
+
+func (i *Images) blobReleaseFSM(data []byte) interface{} {
+	args := new(blobArgs)
+	ret := new(blobRet)
+	err := decode(data, args)
+	if err != nil {
+		return ret
+	}
+	ret.Ok, ret.Dead = i.s.data.blobsRelease(args.Checksum)
+	return ret
+}
+
+func (i *Images) blobDeletedFSM(data []byte) interface{} {
+	args := new(blobArgs)
+	ret := new(blobRet)
+	err := decode(data, args)
+	if err != nil {
+		return ret
+	}
+	ret.Ok = i.s.data.blobsDeleted(args.Checksum)
+	return ret
+}
+
+func (i *Images) blobSizedFSM(data []byte) interface{} {
+	args := new(blobArgs)
+	ret := new(blobRet)
+	err := decode(data, args)
+	if err != nil {
+		return ret
+	}
+	ret.Ok = i.s.data.blobsSized(args.Checksum, args.Size)
+	return ret
+}
+
+// sizeBlobs records the sizes of stored blobs whose size isn't known, such
+// as those that were in storage before sizes were recorded. Blobs this node
+// doesn't hold are left for the nodes that do.
+func (i *Images) sizeBlobs() {
+	chks, err := i.s.data.blobsUnsized()
+	if err != nil {
+		i.log.Error("couldn't list blobs without sizes", "error", err)
+		return
+	}
+	for _, chk := range chks {
+		size, err := i.storage().Stat(chk)
+		if err != nil || size == 0 {
+			continue
+		}
+		ret := i.s.sync("blobSized", &blobArgs{Checksum: chk, Size: size})
+		if x, ok := ret.(*blobRet); !ok || !x.Ok {
+			i.log.Error("failed to record blob size", "checksum", chk)
+		}
+	}
+}
+
+// reserve takes a reference to a blob before it is put in storage, reporting
+// whether it is already stored. If the blob is dead and still being removed
+// by another node, reserve waits for the removal to finish.
+func (i *Images) reserve(chk string) (bool, error) {
+	for attempt := 0; attempt < reserveAttempts; attempt++ {
+		ret := i.s.sync("blobReserve", &blobArgs{Checksum: chk})
+		x, ok := ret.(*blobRet)
+		if ok && x.Ok {
+			return x.Stored, nil
+		}
+		time.Sleep(reserveBackoff)
+	}
+	return false, errBlobBusy
+}
+
+// release gives up a reservation taken by reserve, removing the blob from
+// storage if nothing else refers to it.
+func (i *Images) release(chk string) {
+	ret := i.s.sync("blobRelease", &blobArgs{Checksum: chk})
+	x, ok := ret.(*blobRet)
+	if !ok || !x.Ok {
+		i.log.Error("failed to release blob reservation", "checksum", chk)
+		return
+	}
+	if x.Dead {
+		i.collect([]string{chk})
+	}
+}
+
+// collect removes dead blobs from storage and confirms their removal so the
+// checksums can be reserved again. Blobs that can't be removed stay dead.
+func (i *Images) collect(chks []string) {
+	for _, chk := range chks {
+		err := i.storage().Delete(chk)
+		if err != nil && !os.IsNotExist(err) {
+			i.log.Error("failed to delete unreferenced blob from storage", "checksum", chk, "error", err)
+			continue
+		}
+		ret := i.s.sync("blobDeleted", &blobArgs{Checksum: chk})
+		if x, ok := ret.(*blobRet); !ok || !x.Ok {
+			i.log.Error("failed to confirm blob deletion", "checksum", chk)
+		}
+	}
+}
@@ -17,6 +17,7 @@ type configuration struct {
 	Modules   map[string]map[string]string `yaml:"modules"`
 	Raft      raft.Config                  `yaml:"raft"`
 	Storage   storageConfiguration         `yaml:"storage"`
+	Mirrors   mirrorConfiguration          `yaml:"mirrors"`
 }
 
 func (c *configuration) load(path string) error {
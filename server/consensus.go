@@ -14,6 +14,11 @@ import (
 func (s *Server) sync(fn string, arg interface{}) interface{} {
 	s.log.Debug("syncing: "+fn, "module", "fsm")
 	data := encode(arg)
+	if s.raft.client == nil {
+		// without raft, as in tests, commands go straight to the local
+		// state machine
+		return s.raft.fsm.actions[fn](data)
+	}
 	ld := logData{
 		Fn:  fn,
 		Gob: data,
@@ -44,6 +49,26 @@ func (f *fsm) setup(s *Server) {
 	f.actions["imagesUploadOW"] = s.images.uploadOWFSM
 	f.actions["imagesUpload"] = s.images.uploadFSM
 	f.actions["imagesAttrOW"] = s.images.attributesFSM
+	f.actions["imagesChmod"] = s.images.chmodFSM
+	f.actions["imagesMove"] = s.images.moveFSM
+	f.actions["imagesMkdir"] = s.images.mkdirFSM
+	f.actions["imagesExtract"] = s.images.extractFSM
+	f.actions["blobReserve"] = s.images.blobReserveFSM
+	f.actions["blobRelease"] = s.images.blobReleaseFSM
+	f.actions["blobDeleted"] = s.images.blobDeletedFSM
+	f.actions["blobHeld"] = s.images.blobHeldFSM
+	f.actions["blobSized"] = s.images.blobSizedFSM
+	f.actions["nodeJoin"] = s.images.nodeJoinFSM
+	f.actions["storageFlip"] = s.images.flipFSM
+	f.actions["quotaSet"] = s.images.quotaSetFSM
+	f.actions["imagesSign"] = s.images.signatureFSM
+	f.actions["imagesTrust"] = s.images.trustFSM
+	f.actions["imagesProtect"] = s.images.protectFSM
+	f.actions["presignKey"] = s.images.presignKeyFSM
+	f.actions["imagesMirror"] = s.images.mirrorSetFSM
+	f.actions["mirrorSynced"] = s.images.mirrorSyncedFSM
+	f.actions["mirrorClaim"] = s.images.mirrorClaimFSM
+	f.actions["revisionsPrune"] = s.images.revisionsPruneFSM
 }
 
 func encode(obj interface{}) []byte {
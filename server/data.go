@@ -2,9 +2,11 @@ package server
 
 import (
 	"database/sql"
+	"errors"
 	"os"
 	"strconv"
 	"strings"
+	"unicode/utf8"
 
 	"gopkg.in/inconshreveable/log15.v2"
 
@@ -45,6 +47,16 @@ func (d *Data) Setup(base, path string, log log15.Logger) error {
 	d.initJournal()
 	d.initJData()
 	d.initImages()
+	d.initBlobs()
+	d.initReplication()
+	d.initSettings()
+	d.initQuotas()
+	d.initRevisions()
+	d.initLabels()
+	d.initBlobMeta()
+	d.initSearch()
+	d.initSignatures()
+	d.initMirrors()
 	return d.err
 }
 
@@ -80,8 +92,141 @@ func (d *Data) initImages() {
 	_, d.err = d.db.Exec(tblImages)
 }
 
+// initBlobs creates the blobs table and adds reference counts for images
+// stored before blobs were tracked.
+func (d *Data) initBlobs() {
+	if d.err != nil {
+		return
+	}
+	_, d.err = d.db.Exec(tblBlobs)
+	if d.err != nil {
+		return
+	}
+	d.addColumn("blobs", "size", "INTEGER NOT NULL DEFAULT 0")
+	if d.err != nil {
+		return
+	}
+	// sizes of backfilled blobs are filled in later by the collector
+	_, d.err = d.db.Exec("INSERT OR IGNORE INTO blobs(chk, refs, stored) SELECT chk, COUNT(*), 1 FROM images WHERE chk IS NOT NULL AND chk != '' GROUP BY chk")
+}
+
+// addColumn adds a column to a table created by an older version of the
+// server, if it isn't there already.
+func (d *Data) addColumn(table, column, def string) {
+	rows, err := d.db.Query("PRAGMA table_info(" + table + ")")
+	if err != nil {
+		d.err = err
+		return
+	}
+	found := false
+	for rows.Next() {
+		var cid, notnull, pk int
+		var name, ctype string
+		var dflt sql.NullString
+		err = rows.Scan(&cid, &name, &ctype, &notnull, &dflt, &pk)
+		if err != nil {
+			rows.Close()
+			d.err = err
+			return
+		}
+		if name == column {
+			found = true
+		}
+	}
+	rows.Close()
+	if !found {
+		_, d.err = d.db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + def)
+	}
+}
+
+func (d *Data) initReplication() {
+	if d.err != nil {
+		return
+	}
+	_, d.err = d.db.Exec(tblNodes)
+	if d.err != nil {
+		return
+	}
+	_, d.err = d.db.Exec(tblHolders)
+}
+
+func (d *Data) initRevisions() {
+	if d.err != nil {
+		return
+	}
+	_, d.err = d.db.Exec(tblRevisions)
+}
+
+// initSearch creates the full-text search index and its triggers, and
+// indexes anything created before the index existed.
+func (d *Data) initSearch() {
+	if d.err != nil {
+		return
+	}
+	_, d.err = d.db.Exec(tblSearch)
+	if d.err != nil {
+		return
+	}
+	_, d.err = d.db.Exec(trgSearch)
+	if d.err != nil {
+		return
+	}
+	_, d.err = d.db.Exec(`INSERT INTO search(docid, name, desc, auth, labels)
+		SELECT files.id, files.name, COALESCE(images.desc, ''), COALESCE(images.auth, ''), COALESCE((SELECT group_concat(key || ' ' || val, ' ') FROM labels WHERE labels.id = files.id), '')
+		FROM files LEFT JOIN images ON images.id = files.id
+		WHERE files.type IN ('file', 'folder') AND files.id NOT IN (SELECT docid FROM search)`)
+}
+
+func (d *Data) initSignatures() {
+	for _, tbl := range []string{tblSignatures, tblTrust, tblProtected} {
+		if d.err != nil {
+			return
+		}
+		_, d.err = d.db.Exec(tbl)
+	}
+}
+
+func (d *Data) initMirrors() {
+	if d.err != nil {
+		return
+	}
+	_, d.err = d.db.Exec(tblMirrors)
+}
+
+func (d *Data) initBlobMeta() {
+	if d.err != nil {
+		return
+	}
+	_, d.err = d.db.Exec(tblBlobMeta)
+}
+
+func (d *Data) initLabels() {
+	if d.err != nil {
+		return
+	}
+	_, d.err = d.db.Exec(tblLabels)
+	if d.err != nil {
+		return
+	}
+	_, d.err = d.db.Exec(tblTags)
+}
+
+func (d *Data) initQuotas() {
+	if d.err != nil {
+		return
+	}
+	_, d.err = d.db.Exec(tblQuotas)
+}
+
+func (d *Data) initSettings() {
+	if d.err != nil {
+		return
+	}
+	_, d.err = d.db.Exec(tblSettings)
+}
+
 func (d *Data) insertFile(ftype, path, name string, r *Rules) error {
-	_, err := d.db.Exec("INSERT INTO files(type, path, name, own, grp, mod)", ftype, path, name, r.Owner, r.Group, r.Mode)
+	_, err := d.db.Exec("INSERT INTO files(type, path, name, own, grp, mod) VALUES(?,?,?,?,?,?)", ftype, path, name, r.Owner, r.Group, r.Mode)
 	if err != nil {
 		if !strings.HasPrefix(err.Error(), "UNIQUE") {
 			return err
@@ -258,14 +403,14 @@ func (d *Data) getRules(path, name string) (*Rules, error) {
 }
 
 func (d *Data) imagesGetAttributes(path, name string) (string, string, uint64, string, error) {
-	row := d.db.QueryRow("SELECT auth, desc, time, chk FROM images JOIN files ON images.id = files.id WHERE path=? AND name=?", path, name)
+	row := d.db.QueryRow("SELECT COALESCE(auth, ''), COALESCE(desc, ''), COALESCE(time, 0), COALESCE(chk, '') FROM files LEFT JOIN images ON images.id = files.id WHERE path=? AND name=?", path, name)
 	auth := ""
 	desc := ""
 	date := uint64(0)
 	chk := ""
 	err := row.Scan(&auth, &desc, &date, &chk)
 	if err != nil {
-		panic(err)
+		return "", "", 0, "", err
 	}
 	return auth, desc, date, chk, nil
 }
@@ -275,59 +420,109 @@ func (d *Data) imagesGetInfo(path, name string) (string, error) {
 	row := d.db.QueryRow("SELECT type FROM files where path=? AND name=?", path, name)
 	err := row.Scan(&chkType)
 	if err != nil {
-		panic(err)
+		return "", err
 	}
 	if chkType == "folder" {
-		return chkType
+		return chkType, nil
 	}
 	row = d.db.QueryRow("SELECT chk FROM images JOIN files ON images.id = files.id WHERE path=? AND name=?", path, name)
 	err = row.Scan(&chkType)
 	if err != nil {
-		panic(err)
+		return "", err
 	}
-	return chkType
+	return chkType, nil
 }
 
-func (d *Data) imagesGetFolder(path, name, filter, sort, order string, offset, length int) *shortPL {
-	ordstr := "type DESC, name DESC"
-	if sort != "" {
-		ordstr = "sort "
-		if order == "ASC" || order == "DESC" {
-			ordstr = append(ordstr, order)
-		} else {
-			ordstr = append(ordstr, "DESC")
+type folderSort struct {
+	expr    string
+	numeric bool
+}
+
+var folderSorts = map[string]folderSort{
+	"name":   {"files.name", false},
+	"type":   {"files.type", false},
+	"date":   {"COALESCE(images.time, 0)", true},
+	"size":   {"COALESCE(blobs.size, 0)", true},
+	"author": {"COALESCE(images.auth, '')", false},
+}
+
+var errBadCursor = errors.New("bad cursor")
+
+// imagesGetFolder lists the children of the folder at path/name. Pages are
+// chained with keyset cursors holding the sort key and name of the last
+// child of the previous page, rather than offsets, so children added or
+// removed while a listing is paged through don't shift later pages.
+func (d *Data) imagesGetFolder(path, name string, args *listArgs) (*shortPL, error) {
+	srt, ok := folderSorts[args.Sort]
+	if !ok {
+		return nil, errBadSort
+	}
+	dir, cmp := " ASC", ">"
+	if args.Desc {
+		dir, cmp = " DESC", "<"
+	}
+
+	where := "files.path=?"
+	vals := []interface{}{path + "/" + name}
+	if args.Filter != "" {
+		where += " AND files.name LIKE ? ESCAPE '\\'"
+		vals = append(vals, "%"+likeEscaper.Replace(args.Filter)+"%")
+	}
+	from := " FROM files LEFT JOIN images ON images.id = files.id LEFT JOIN blobs ON blobs.chk = images.chk WHERE "
+
+	pl := new(shortPL)
+	err := d.db.QueryRow("SELECT COUNT(*)"+from+where, vals...).Scan(&pl.Length)
+	if err != nil {
+		return nil, err
+	}
+
+	if args.Cursor != nil {
+		var key interface{} = args.Cursor.Key
+		if srt.numeric {
+			key, err = strconv.ParseInt(args.Cursor.Key, 10, 64)
+			if err != nil {
+				return nil, errBadCursor
+			}
 		}
+		where += " AND (" + srt.expr + cmp + "? OR (" + srt.expr + "=? AND files.name" + cmp + "?))"
+		vals = append(vals, key, key, args.Cursor.Name)
 	}
-	rows, err = d.db.Query("SELECT name, type FROM files WHERE path=? AND name LIKE '%?%' ORDER BY "+ordstr+" LIMIT ?,?", path+"/"+name, filter, offset, length)
+	vals = append(vals, args.Length)
+
+	rows, err := d.db.Query("SELECT files.name, files.type, files.own, files.grp, files.mod, COALESCE(images.auth, ''), COALESCE(images.desc, ''), COALESCE(images.time, 0), COALESCE(images.chk, ''), COALESCE(blobs.size, 0), "+srt.expr+from+where+" ORDER BY "+srt.expr+dir+", files.name"+dir+" LIMIT ?", vals...)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	defer rows.Close()
 
-	pl := new(shortPL)
+	pl.List = []folderPL{}
+	var key string
 	for rows.Next() {
-		n, t := ""
-		err = rows.Scan(&n, &t)
+		var f folderPL
+		l := new(longPL)
+		err = rows.Scan(&f.Name, &f.Type, &l.Owner, &l.Group, &l.Mode, &l.Author, &l.Description, &l.Date, &l.Checksum, &l.Size, &key)
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
-		pl.List = append(pl.List, folderPL{n, t})
-	}
-
-	count := 0
-	row := d.db.QueryRow("SELECT COUNT(*) FROM files WHERE path=? AND name LIKE '%?%' ORDER BY "+ordstr+" LIMIT ?,?", path+"/"+name, filter, offset, length)
-	if err != nil {
-		panic(err)
+		if args.Long {
+			f.longPL = l
+		}
+		pl.List = append(pl.List, f)
 	}
-	err = row.Scan(&count)
+	err = rows.Err()
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	pl.Length = count
 
-	return pl
+	if len(pl.List) == args.Length {
+		last := pl.List[len(pl.List)-1]
+		pl.Next = encodeCursor(&listCursor{key, last.Name})
+	}
+	return pl, nil
 }
 
+var likeEscaper = strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_")
+
 func (d *Data) hasChildren(path, name string) bool {
 	rows, err := d.db.Query("SELECT * FROM files WHERE path=?", path+"/"+name)
 	if err != nil {
@@ -342,131 +537,1692 @@ func (d *Data) hasChildren(path, name string) bool {
 	return false
 }
 
-func (d *Data) imagesDelete(path, name string) (bool, string) {
-	row := d.db.QueryRow("SELECT chk FROM images JOIN files ON images.id = files.id WHERE path=? AND name=?", path, name)
-	chk := ""
-	err := row.Scan(&chk)
+// descendants returns a WHERE clause fragment and its arguments that select
+// every file beneath the folder at path/name. Paths are compared as a range
+// rather than with LIKE so names containing wildcards are handled safely.
+func descendants(path, name string) (string, []interface{}) {
+	full := path + "/" + name
+	return "(path=? OR (path>=? AND path<?))", []interface{}{full, full + "/", full + "0"}
+}
+
+// subtreeClause returns a WHERE clause fragment and its arguments that select
+// the file at path/name together with all of its descendants.
+func subtreeClause(path, name string) (string, []interface{}) {
+	clause, args := descendants(path, name)
+	return "((path=? AND name=?) OR " + clause + ")", append([]interface{}{path, name}, args...)
+}
+
+type fileNode struct {
+	ID    int64
+	Type  string
+	Path  string
+	Name  string
+	Rules Rules
+}
+
+// subtree returns the file at path/name followed by all of its descendants,
+// ordered so that every folder precedes its children.
+func (d *Data) subtree(path, name string) ([]fileNode, error) {
+	return querySubtree(d.db, path, name)
+}
+
+type querier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func querySubtree(q querier, path, name string) ([]fileNode, error) {
+	clause, args := subtreeClause(path, name)
+	rows, err := q.Query("SELECT id, type, path, name, own, grp, mod FROM files WHERE "+clause+" ORDER BY length(path), path, name", args...)
 	if err != nil {
-		return false, ""
+		return nil, err
 	}
+	defer rows.Close()
 
-	_, err := d.db.Exec("DELETE FROM files WHERE path=? AND name=?", path, name)
-	if err != nil {
-		return false, ""
+	var nodes []fileNode
+	for rows.Next() {
+		var n fileNode
+		err = rows.Scan(&n.ID, &n.Type, &n.Path, &n.Name, &n.Rules.Owner, &n.Rules.Group, &n.Rules.Mode)
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, n)
 	}
+	return nodes, rows.Err()
+}
+
+// archiveNode is a file in a folder being archived, with the attributes of
+// images filled in.
+type archiveNode struct {
+	fileNode
+	Author      string
+	Description string
+	Time        uint64
+	Checksum    string
+}
 
-	k := 0
-	row := d.db.QueryRow("SELECT COUNT(*) FROM images WHERE chk=?", chk)
-	err := row.Scan(&k)
+// imagesArchive returns the file at path/name and everything beneath it,
+// ordered so that every folder precedes its children.
+func (d *Data) imagesArchive(path, name string) ([]archiveNode, error) {
+	clause, args := subtreeClause(path, name)
+	rows, err := d.db.Query("SELECT files.id, type, path, name, own, grp, mod, COALESCE(auth, ''), COALESCE(desc, ''), COALESCE(time, 0), COALESCE(chk, '') FROM files LEFT JOIN images ON images.id = files.id WHERE "+clause+" ORDER BY length(path), path, name", args...)
 	if err != nil {
-		return false, ""
+		return nil, err
 	}
+	defer rows.Close()
 
-	if k == 0 {
-		return true, chk
-	} else {
-		return true, ""
+	var nodes []archiveNode
+	for rows.Next() {
+		var n archiveNode
+		err = rows.Scan(&n.ID, &n.Type, &n.Path, &n.Name, &n.Rules.Owner, &n.Rules.Group, &n.Rules.Mode, &n.Author, &n.Description, &n.Time, &n.Checksum)
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, n)
 	}
-
+	return nodes, rows.Err()
 }
 
-func (d *Data) imagesAdd(args uploadData) (bool, string) {
-	path, name := splitPath(args.Target)
-	row := d.db.QueryRow("SELECT COUNT (*) FROM images JOIN files ON images.id = files.id WHERE path=? AND name=?", path, name)
-	count := 0
-	err := row.Scan(&count)
+// imagesDelete removes the file at path/name, everything beneath it and all
+// their revisions in a single transaction. It returns the checksums of blobs
+// that are no longer referenced and can be removed from storage.
+func (d *Data) imagesDelete(path, name string) (bool, []string) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return false, nil
+	}
+	defer tx.Rollback()
+
+	// revisions hold references to their blobs too
+	clause, args := subtreeClause(path, name)
+	rows, err := tx.Query("SELECT chk FROM images JOIN files ON images.id = files.id WHERE "+clause+" UNION ALL SELECT chk FROM revisions JOIN files ON revisions.file = files.id WHERE "+clause, append(args, args...)...)
+	if err != nil {
+		return false, nil
+	}
+	var chks []string
+	for rows.Next() {
+		chk := ""
+		err = rows.Scan(&chk)
+		if err != nil {
+			rows.Close()
+			return false, nil
+		}
+		chks = append(chks, chk)
+	}
+	rows.Close()
+
+	res, err := tx.Exec("DELETE FROM files WHERE "+clause, args...)
 	if err != nil {
-		return false, ""
+		return false, nil
 	}
-	if count != 0 {
-		return false, ""
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return false, nil
 	}
 
-	ftype := "file"
-	if args.Checksum == emptyChecksum {
-		ftype = "folder"
+	var garbage []string
+	for _, chk := range chks {
+		dead, err := blobUnref(tx, chk)
+		if err != nil {
+			return false, nil
+		}
+		if dead {
+			garbage = append(garbage, chk)
+		}
 	}
 
-	res, err = d.db.Exec("INSERT INTO files(type, name, path, own, grp, mod)", ftype, name, path, args.Owner, args.Group, args.Mode)
+	err = tx.Commit()
 	if err != nil {
-		return false, ""
+		return false, nil
+	}
+	return true, garbage
+}
+
+// imagesChmod applies the mode and ownership changes in args to the target,
+// and to everything beneath it if the change is recursive.
+func (d *Data) imagesChmod(args *imgChmodArgs) error {
+	var set []string
+	var vals []interface{}
+	if args.ModeSet {
+		set = append(set, "mod=?")
+		vals = append(vals, args.Mode)
+	}
+	if args.OwnerSet {
+		set = append(set, "own=?")
+		vals = append(vals, args.Owner)
+	}
+	if args.GroupSet {
+		set = append(set, "grp=?")
+		vals = append(vals, args.Group)
+	}
+	if len(set) == 0 {
+		return errNoChange
 	}
 
-	id, err := res.LastInsertId()
+	tx, err := d.db.Begin()
 	if err != nil {
-		return false, ""
+		return err
+	}
+	defer tx.Rollback()
+
+	path, name := splitPath(args.Target)
+	clause := "(path=? AND name=?)"
+	cargs := []interface{}{path, name}
+	if args.Recursive {
+		clause, cargs = subtreeClause(path, name)
 	}
 
-	_, err = d.db.Exec("INSERT INTO images(id, auth, desc, time, chk) VALUES(?,?,?,?,?)", id, args.Author, args.Description, args.Time, args.Checksum)
+	res, err := tx.Exec("UPDATE files SET "+strings.Join(set, ", ")+" WHERE "+clause, append(vals, cargs...)...)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
 	if err != nil {
-		return false, ""
+		return err
+	}
+	if n == 0 {
+		return errNoSuchFile
+	}
+
+	// handing files to someone else counts against their quota
+	if args.OwnerSet {
+		err = checkQuota(tx, quotaUser, args.Owner)
+		if err != nil {
+			return err
+		}
+	}
+	if args.GroupSet {
+		err = checkQuota(tx, quotaGroup, args.Group)
+		if err != nil {
+			return err
+		}
 	}
 
-	return true, ""
+	return tx.Commit()
 }
 
-func (d *Data) imagesOverwrite(args uploadData) (bool, string) {
-	path, name := splitPath(args.Target)
-	row := d.db.QueryRow("SELECT auth, desc, time, chk FROM images JOIN files ON images.id = files.id WHERE path=? AND name=?", path, name)
-	var auth, desc, chk string
-	var time uint64
-	err := row.Scan(&auth, &desc, &time, &chk)
+// checkDestination verifies that dest is free and that its parent is an
+// existing folder.
+func checkDestination(q querier, dest string) bool {
+	parent, name := splitPath(dest)
+	ppath, pname := splitPath(parent)
+	ftype := ""
+	err := q.QueryRow("SELECT type FROM files WHERE path=? AND name=?", ppath, pname).Scan(&ftype)
+	if err != nil || ftype != "folder" {
+		return false
+	}
+	count := 0
+	err = q.QueryRow("SELECT COUNT(*) FROM files WHERE path=? AND name=?", parent, name).Scan(&count)
+	return err == nil && count == 0
+}
+
+// imagesMove renames the source file to the destination and rewrites the
+// paths of everything beneath it.
+func (d *Data) imagesMove(args *imgMoveArgs) bool {
+	tx, err := d.db.Begin()
 	if err != nil {
-		return false, ""
+		return false
 	}
+	defer tx.Rollback()
 
-	if !args.AuthSet {
-		args.Author = auth
+	if !checkDestination(tx, args.Dest) {
+		return false
 	}
-	if !args.DescSet {
-		args.Description = desc
+	path, name := splitPath(args.Source)
+	dpath, dname := splitPath(args.Dest)
+	res, err := tx.Exec("UPDATE files SET path=?, name=? WHERE path=? AND name=?", dpath, dname, path, name)
+	if err != nil {
+		return false
 	}
-	if !args.TimeSet {
-		args.Time = time
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return false
 	}
 
-	_, err = d.db.Exec("UPDATE images SET auth=?, desc=?, time=?, chk=? WHERE path=? AND name=?", args.Author, args.Description, args.Time, args.Checksum, path, name)
+	clause, cargs := descendants(path, name)
+	skip := utf8.RuneCountInString(args.Source) + 1
+	_, err = tx.Exec("UPDATE files SET path = ? || substr(path, ?) WHERE "+clause, append([]interface{}{args.Dest, skip}, cargs...)...)
 	if err != nil {
-		return false, ""
+		return false
 	}
 
-	row = d.db.QueryRow("SELECT COUNT(*) FROM images WHERE chk=?", chk)
-	count := 0
-	err = row.Scan(&count)
+	// tags follow the images they point at into their new folders, except
+	// where a tag of the same name is already set there
+	_, err = tx.Exec("UPDATE OR IGNORE tags SET folder = (SELECT path FROM files WHERE files.id = tags.file) WHERE folder <> (SELECT path FROM files WHERE files.id = tags.file)")
 	if err != nil {
-		return false, ""
+		return false
 	}
-
-	if count == 0 {
-		return true, chk
+	_, err = tx.Exec("DELETE FROM tags WHERE folder <> (SELECT path FROM files WHERE files.id = tags.file)")
+	if err != nil {
+		return false
 	}
-	return true, ""
+
+	return tx.Commit() == nil
 }
 
-func (d *Data) imagesAttr(args uploadData) bool {
-	path, name := splitPath(args.Target)
-	row := d.db.QueryRow("SELECT auth, desc, time, chk FROM images JOIN files ON images.id = files.id WHERE path=? AND name=?", path, name)
-	var auth, desc, chk string
-	var time uint64
-	err := row.Scan(&auth, &desc, &time, &chk)
+// imagesCopy duplicates the source file and everything beneath it at the
+// destination. Copies are owned by the caller and share the checksums of the
+// originals, so no blobs are duplicated in storage.
+func (d *Data) imagesCopy(args *imgMoveArgs) error {
+	tx, err := d.db.Begin()
 	if err != nil {
-		return false
+		return err
 	}
+	defer tx.Rollback()
 
-	if !args.AuthSet {
-		args.Author = auth
+	if !checkDestination(tx, args.Dest) {
+		return errNotFolder
 	}
-	if !args.DescSet {
-		args.Description = desc
+	path, name := splitPath(args.Source)
+	nodes, err := querySubtree(tx, path, name)
+	if err != nil {
+		return err
 	}
-	if !args.TimeSet {
-		args.Time = time
+	if len(nodes) == 0 {
+		return errNoSuchFile
+	}
+
+	for _, node := range nodes {
+		target := args.Dest + strings.TrimPrefix(node.Path+"/"+node.Name, args.Source)
+		path, name := splitPath(target)
+		res, err := tx.Exec("INSERT INTO files(type, name, path, own, grp, mod) VALUES(?,?,?,?,?,?)", node.Type, name, path, args.Owner, args.Group, node.Rules.Mode)
+		if err != nil {
+			return err
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("INSERT INTO images(id, time, auth, desc, chk) SELECT ?, time, auth, desc, chk FROM images WHERE id=?", id, node.ID)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("UPDATE blobs SET refs = refs + 1 WHERE chk = (SELECT chk FROM images WHERE id=?)", id)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("INSERT INTO labels(id, key, val) SELECT ?, key, val FROM labels WHERE id=?", id, node.ID)
+		if err != nil {
+			return err
+		}
 	}
 
-	_, err = d.db.Exec("UPDATE images SET auth=?, desc=?, time=? WHERE path=? AND name=?", args.Author, args.Description, args.Time, path, name)
+	err = checkQuotas(tx, args.Owner, args.Group)
 	if err != nil {
-		return false
+		return err
 	}
 
-	return true
+	return tx.Commit()
+}
+
+var (
+	errNotFolder  = errors.New("not a folder")
+	errNoSuchFile = errors.New("no such file")
+	errNoChange   = errors.New("nothing to change")
+)
+
+// makeParents creates every missing folder above target with the given
+// rules, as mkdir -p would. It fails if an existing ancestor is not a folder.
+// The folders it creates are recorded in created unless it is nil.
+func makeParents(tx *sql.Tx, target string, r *Rules, created map[string]bool) error {
+	dir, _ := splitPath(target)
+	parent := ""
+	for _, elem := range strings.Split(dir, "/") {
+		if elem == "" {
+			continue
+		}
+		ftype := ""
+		err := tx.QueryRow("SELECT type FROM files WHERE path=? AND name=?", parent, elem).Scan(&ftype)
+		switch {
+		case err == sql.ErrNoRows:
+			_, err = tx.Exec("INSERT INTO files(type, name, path, own, grp, mod) VALUES(?,?,?,?,?,?)", "folder", elem, parent, r.Owner, r.Group, r.Mode)
+			if err != nil {
+				return err
+			}
+			if created != nil {
+				created[parent+"/"+elem] = true
+			}
+		case err != nil:
+			return err
+		case ftype != "folder":
+			return errNotFolder
+		}
+		parent = parent + "/" + elem
+	}
+	return nil
+}
+
+// existingAncestor returns the deepest folder above target that already
+// exists, which is the folder a mkdir -p style request will write into.
+func (d *Data) existingAncestor(target string) string {
+	dir, _ := splitPath(target)
+	for dir != "" {
+		path, name := splitPath(dir)
+		ftype := ""
+		err := d.db.QueryRow("SELECT type FROM files WHERE path=? AND name=?", path, name).Scan(&ftype)
+		if err == nil {
+			return dir
+		}
+		dir, _ = splitPath(dir)
+	}
+	return dir
+}
+
+// imagesCreate inserts a new file of type ftype described by args, creating
+// missing parent folders first if requested. The parent must be an existing
+// folder and the target must not already exist.
+func imagesCreate(tx *sql.Tx, ftype string, args *uploadData) (int64, error) {
+	if args.Parents {
+		err := makeParents(tx, args.Target, &Rules{args.Owner, args.Group, args.Mode}, nil)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if !checkDestination(tx, args.Target) {
+		return 0, errNotFolder
+	}
+	path, name := splitPath(args.Target)
+	res, err := tx.Exec("INSERT INTO files(type, name, path, own, grp, mod) VALUES(?,?,?,?,?,?)", ftype, name, path, args.Owner, args.Group, args.Mode)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func (d *Data) imagesAdd(args *uploadData) ([]string, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	id, err := imagesCreate(tx, "file", args)
+	if err != nil {
+		return nil, err
+	}
+	err = blobClaim(tx, args)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec("INSERT INTO images(id, auth, desc, time, chk) VALUES(?,?,?,?,?)", id, args.Author, args.Description, args.Time, args.Checksum)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkQuotas(tx, args.Owner, args.Group)
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, tx.Commit()
+}
+
+// makeFolder creates the folder described by args unless it already
+// exists.
+func makeFolder(tx *sql.Tx, args *uploadData) error {
+	path, name := splitPath(args.Target)
+	ftype := ""
+	err := tx.QueryRow("SELECT type FROM files WHERE path=? AND name=?", path, name).Scan(&ftype)
+	switch {
+	case err == sql.ErrNoRows:
+		_, err = imagesCreate(tx, "folder", args)
+		return err
+	case err != nil:
+		return err
+	case ftype != "folder":
+		return errNotFolder
+	}
+	return nil
+}
+
+// imagesExtract creates the folders and images unpacked from an archive
+// beneath args.Target, creating the target itself if need be. Every image
+// must be new, and the blobs they hold are claimed from the reservations
+// taken when they were stored. Folders the archive implies without listing
+// are created with args.Mode, and take the mode of their own entry if it
+// only comes after their contents.
+func (d *Data) imagesExtract(args *archiveArgs) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = makeFolder(tx, &uploadData{Owner: args.Owner, Group: args.Group, Mode: args.Mode, Target: args.Target, Parents: args.Parents})
+	if err != nil {
+		return err
+	}
+
+	created := make(map[string]bool)
+	for _, e := range args.Entries {
+		target := args.Target + "/" + e.Path
+		err = makeParents(tx, target, &Rules{args.Owner, args.Group, args.Mode}, created)
+		if err != nil {
+			return err
+		}
+		ul := &uploadData{
+			Owner:       args.Owner,
+			Group:       args.Group,
+			Mode:        e.Mode,
+			Target:      target,
+			Author:      e.Author,
+			Description: e.Description,
+			Time:        e.Time,
+			Checksum:    e.Checksum,
+			Reserved:    true,
+			Node:        args.Node,
+			Size:        e.Size,
+			Meta:        e.Meta,
+		}
+		if e.Type == "folder" && created[target] {
+			path, name := splitPath(target)
+			_, err = tx.Exec("UPDATE files SET mod=? WHERE path=? AND name=?", e.Mode, path, name)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if e.Type == "folder" {
+			err = makeFolder(tx, ul)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		var id int64
+		id, err = imagesCreate(tx, "file", ul)
+		if err != nil {
+			return err
+		}
+		err = blobClaim(tx, ul)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("INSERT INTO images(id, auth, desc, time, chk) VALUES(?,?,?,?,?)", id, ul.Author, ul.Description, ul.Time, ul.Checksum)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = checkQuotas(tx, args.Owner, args.Group)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// imagesMkdir creates the folder described by args.
+func (d *Data) imagesMkdir(args *uploadData) bool {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return false
+	}
+	defer tx.Rollback()
+
+	_, err = imagesCreate(tx, "folder", args)
+	if err != nil {
+		return false
+	}
+
+	return tx.Commit() == nil
+}
+
+// imagesOverwrite replaces the contents of an image, keeping what it held
+// before as a new revision. Revisions that fall outside the retention rules
+// in args are dropped, and the checksums of blobs no longer referenced are
+// returned so they can be removed from storage.
+func (d *Data) imagesOverwrite(args *uploadData) ([]string, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	path, name := splitPath(args.Target)
+	row := tx.QueryRow("SELECT files.id, auth, desc, time, chk, own, grp FROM images JOIN files ON images.id = files.id WHERE path=? AND name=?", path, name)
+	var auth, desc, chk, own, grp string
+	var id int64
+	var time uint64
+	err = row.Scan(&id, &auth, &desc, &time, &chk, &own, &grp)
+	if err != nil {
+		return nil, err
+	}
+
+	if !args.AuthSet {
+		args.Author = auth
+	}
+	if !args.DescSet {
+		args.Description = desc
+	}
+	if !args.TimeSet {
+		args.Time = time
+	}
+
+	// the reference the image held passes to the revision
+	_, err = tx.Exec("INSERT INTO revisions(file, rev, time, auth, desc, chk, archived) SELECT ?, COALESCE(MAX(rev), 0) + 1, ?, ?, ?, ?, ? FROM revisions WHERE file=?", id, time, auth, desc, chk, args.Now, id)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec("UPDATE images SET auth=?, desc=?, time=?, chk=? WHERE id=?", args.Author, args.Description, args.Time, args.Checksum, id)
+	if err != nil {
+		return nil, err
+	}
+
+	err = blobClaim(tx, args)
+	if err != nil {
+		return nil, err
+	}
+	garbage, err := pruneRevisions(tx, id, args)
+	if err != nil {
+		return nil, err
+	}
+
+	// the file keeps its owner, so the new contents count against theirs
+	err = checkQuotas(tx, own, grp)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return garbage, nil
+}
+
+// pruneRevisions drops the revisions of a file beyond the newest KeepLast,
+// and those archived more than KeepDays before Now. Zero limits keep
+// everything, and revisions a tag points at are always kept.
+func pruneRevisions(tx *sql.Tx, file int64, args *uploadData) ([]string, error) {
+	return pruneRevisionsWhere(tx, "file=?", []interface{}{file}, args)
+}
+
+// revisionsPrune applies the retention limits in args to the revisions of
+// every image, returning the blobs left unreferenced.
+func (d *Data) revisionsPrune(args *uploadData) ([]string, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	garbage, err := pruneRevisionsWhere(tx, "1", nil, args)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return garbage, nil
+}
+
+// pruneRevisionsWhere applies the retention limits in args to the revisions
+// matching scope.
+func pruneRevisionsWhere(tx *sql.Tx, scope string, scopeVals []interface{}, args *uploadData) ([]string, error) {
+	var clauses []string
+	var vals []interface{}
+	if args.KeepLast > 0 {
+		clauses = append(clauses, "id IN (SELECT r.id FROM revisions r WHERE r.file = revisions.file ORDER BY r.rev DESC LIMIT -1 OFFSET ?)")
+		vals = append(vals, args.KeepLast)
+	}
+	if args.KeepDays > 0 {
+		clauses = append(clauses, "archived < ?")
+		vals = append(vals, args.Now-int64(args.KeepDays)*86400)
+	}
+	if len(clauses) == 0 {
+		return nil, nil
+	}
+	where := scope + " AND id NOT IN (SELECT rev FROM tags WHERE rev IS NOT NULL) AND (" + strings.Join(clauses, " OR ") + ")"
+	vals = append(append([]interface{}{}, scopeVals...), vals...)
+
+	rows, err := tx.Query("SELECT chk FROM revisions WHERE "+where, vals...)
+	if err != nil {
+		return nil, err
+	}
+	var chks []string
+	for rows.Next() {
+		chk := ""
+		err = rows.Scan(&chk)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		chks = append(chks, chk)
+	}
+	rows.Close()
+
+	_, err = tx.Exec("DELETE FROM revisions WHERE "+where, vals...)
+	if err != nil {
+		return nil, err
+	}
+
+	var garbage []string
+	for _, chk := range chks {
+		dead, err := blobUnref(tx, chk)
+		if err != nil {
+			return nil, err
+		}
+		if dead {
+			garbage = append(garbage, chk)
+		}
+	}
+	return garbage, nil
+}
+
+type revision struct {
+	Revision    int    `json:"revision"`
+	Author      string `json:"author"`
+	Description string `json:"description"`
+	Checksum    string `json:"checksum"`
+	Date        uint64 `json:"date"`
+	Archived    int64  `json:"archived,omitempty"`
+	Current     bool   `json:"current,omitempty"`
+}
+
+// imagesRevisions returns the current contents of an image followed by its
+// revisions, newest first. The current contents are numbered as the next
+// revision they will become.
+func (d *Data) imagesRevisions(path, name string) ([]revision, error) {
+	cur := revision{Current: true}
+	err := d.db.QueryRow("SELECT (SELECT COALESCE(MAX(rev), 0) + 1 FROM revisions WHERE file = files.id), auth, desc, chk, time FROM images JOIN files ON images.id = files.id WHERE path=? AND name=?", path, name).Scan(&cur.Revision, &cur.Author, &cur.Description, &cur.Checksum, &cur.Date)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := d.db.Query("SELECT rev, auth, desc, chk, revisions.time, archived FROM revisions JOIN files ON revisions.file = files.id WHERE path=? AND name=? ORDER BY rev DESC", path, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revs := []revision{cur}
+	for rows.Next() {
+		var rev revision
+		err = rows.Scan(&rev.Revision, &rev.Author, &rev.Description, &rev.Checksum, &rev.Date, &rev.Archived)
+		if err != nil {
+			return nil, err
+		}
+		revs = append(revs, rev)
+	}
+	return revs, rows.Err()
+}
+
+// imagesRevision returns a single archived revision of an image.
+func (d *Data) imagesRevision(path, name string, rev int) (*revision, error) {
+	r := &revision{Revision: rev}
+	err := d.db.QueryRow("SELECT auth, desc, chk, revisions.time, archived FROM revisions JOIN files ON revisions.file = files.id WHERE path=? AND name=? AND rev=?", path, name, rev).Scan(&r.Author, &r.Description, &r.Checksum, &r.Date, &r.Archived)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// imagesAttr updates the attributes, labels and tags of an image. Labels set
+// to an empty value are removed. Tags are unique within the folder holding
+// the image, so setting one moves it here from any sibling it pointed at.
+func (d *Data) imagesAttr(args *uploadData) bool {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return false
+	}
+	defer tx.Rollback()
+
+	path, name := splitPath(args.Target)
+	row := tx.QueryRow("SELECT files.id, auth, desc, time, chk FROM images JOIN files ON images.id = files.id WHERE path=? AND name=?", path, name)
+	var auth, desc, chk string
+	var id int64
+	var time uint64
+	err = row.Scan(&id, &auth, &desc, &time, &chk)
+	if err != nil {
+		return false
+	}
+
+	if !args.AuthSet {
+		args.Author = auth
+	}
+	if !args.DescSet {
+		args.Description = desc
+	}
+	if !args.TimeSet {
+		args.Time = time
+	}
+
+	_, err = tx.Exec("UPDATE images SET auth=?, desc=?, time=? WHERE id=?", args.Author, args.Description, args.Time, id)
+	if err != nil {
+		return false
+	}
+
+	for key, val := range args.Labels {
+		if val == "" {
+			_, err = tx.Exec("DELETE FROM labels WHERE id=? AND key=?", id, key)
+		} else {
+			_, err = tx.Exec("INSERT OR REPLACE INTO labels(id, key, val) VALUES(?,?,?)", id, key, val)
+		}
+		if err != nil {
+			return false
+		}
+	}
+
+	for _, tag := range args.Untags {
+		_, err = tx.Exec("DELETE FROM tags WHERE name=? AND file=?", tag, id)
+		if err != nil {
+			return false
+		}
+	}
+	for tag, rev := range args.Tags {
+		var revID interface{}
+		if rev != 0 {
+			var x int64
+			err = tx.QueryRow("SELECT id FROM revisions WHERE file=? AND rev=?", id, rev).Scan(&x)
+			if err != nil {
+				return false
+			}
+			revID = x
+		}
+		_, err = tx.Exec("INSERT OR REPLACE INTO tags(folder, name, file, rev) VALUES(?,?,?,?)", path, tag, id, revID)
+		if err != nil {
+			return false
+		}
+	}
+
+	return tx.Commit() == nil
+}
+
+// imagesLabels returns the labels of a file.
+func (d *Data) imagesLabels(path, name string) (map[string]string, error) {
+	rows, err := d.db.Query("SELECT key, val FROM labels JOIN files ON labels.id = files.id WHERE path=? AND name=?", path, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	labels := make(map[string]string)
+	for rows.Next() {
+		var key, val string
+		err = rows.Scan(&key, &val)
+		if err != nil {
+			return nil, err
+		}
+		labels[key] = val
+	}
+	return labels, rows.Err()
+}
+
+type tagPL struct {
+	Name     string `json:"name"`
+	Path     string `json:"path"`
+	Revision int    `json:"revision,omitempty"`
+	Checksum string `json:"checksum"`
+	Date     uint64 `json:"date"`
+}
+
+// imagesTags returns the tags pointing at a file or its revisions.
+func (d *Data) imagesTags(path, name string) ([]tagPL, error) {
+	rows, err := d.db.Query("SELECT tags.name, COALESCE(revisions.rev, 0) FROM tags JOIN files ON tags.file = files.id LEFT JOIN revisions ON tags.rev = revisions.id WHERE files.path=? AND files.name=? ORDER BY tags.name", path, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tags []tagPL
+	for rows.Next() {
+		var tag tagPL
+		err = rows.Scan(&tag.Name, &tag.Revision)
+		if err != nil {
+			return nil, err
+		}
+		tag.Path = path + "/" + name
+		tags = append(tags, tag)
+	}
+	return tags, rows.Err()
+}
+
+// tagsResolve returns the image, or revision of an image, a tag points at in
+// the nearest of the given folders, judged by the length of their paths.
+func (d *Data) tagsResolve(tag string, folders ...string) (*tagPL, error) {
+	if len(folders) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	vals := []interface{}{tag}
+	for _, folder := range folders {
+		vals = append(vals, folder)
+	}
+	pl := &tagPL{Name: tag}
+	var path, name string
+	err := d.db.QueryRow("SELECT files.path, files.name, COALESCE(revisions.rev, 0), COALESCE(revisions.chk, images.chk), COALESCE(revisions.time, images.time, 0) FROM tags JOIN files ON tags.file = files.id JOIN images ON images.id = files.id LEFT JOIN revisions ON tags.rev = revisions.id WHERE tags.name=? AND tags.folder IN (?"+strings.Repeat(",?", len(folders)-1)+") ORDER BY length(tags.folder) DESC LIMIT 1", vals...).Scan(&path, &name, &pl.Revision, &pl.Checksum, &pl.Date)
+	if err != nil {
+		return nil, err
+	}
+	pl.Path = path + "/" + name
+	return pl, nil
+}
+
+// labelsFind returns the paths of the images beneath path/name carrying
+// every one of the given labels.
+func (d *Data) labelsFind(path, name string, labels map[string]string) ([]string, error) {
+	clause, args := subtreeClause(path, name)
+	for key, val := range labels {
+		clause += " AND EXISTS (SELECT 1 FROM labels WHERE labels.id = files.id AND key=? AND val=?)"
+		args = append(args, key, val)
+	}
+	rows, err := d.db.Query("SELECT path, name FROM files WHERE type='file' AND "+clause+" ORDER BY path, name", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var paths []string
+	for rows.Next() {
+		var p, n string
+		err = rows.Scan(&p, &n)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, p+"/"+n)
+	}
+	return paths, rows.Err()
+}
+
+// blobHolders returns the images whose current contents, or any of whose
+// revisions, are the blob chk.
+func (d *Data) blobHolders(chk string) ([]string, error) {
+	rows, err := d.db.Query("SELECT path, name FROM files WHERE id IN (SELECT id FROM images WHERE chk=? UNION SELECT file FROM revisions WHERE chk=?)", chk, chk)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	targets := []string{}
+	for rows.Next() {
+		var path, name string
+		err = rows.Scan(&path, &name)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, path+"/"+name)
+	}
+	return targets, rows.Err()
+}
+
+var errBlobUnavailable = errors.New("blob unavailable")
+
+// blobClaim records a new image reference to the blob named in args. An
+// upload that reserved the blob before putting it in storage hands its
+// reservation over to the image and marks the blob as stored on the
+// uploading node; anything else takes a new reference to a blob that must
+// already be stored.
+func blobClaim(tx *sql.Tx, args *uploadData) error {
+	if args.Reserved {
+		_, err := tx.Exec("UPDATE blobs SET stored=1, size=MAX(size, ?) WHERE chk=?", args.Size, args.Checksum)
+		if err != nil {
+			return err
+		}
+		if m := args.Meta; m != nil {
+			_, err = tx.Exec("INSERT OR IGNORE INTO blobmeta(chk, mime, format, vsize, version, arch) VALUES(?,?,?,?,?,?)", args.Checksum, m.ContentType, m.Format, m.VirtualSize, m.Version, m.Arch)
+			if err != nil {
+				return err
+			}
+		}
+		if args.Node == "" {
+			return nil
+		}
+		_, err = tx.Exec("INSERT OR IGNORE INTO holders(chk, node) VALUES(?,?)", args.Checksum, args.Node)
+		return err
+	}
+	res, err := tx.Exec("UPDATE blobs SET refs = refs + 1 WHERE chk=? AND stored=1 AND dead=0", args.Checksum)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return errBlobUnavailable
+	}
+	return nil
+}
+
+// blobUnref drops a reference to a blob. When the last reference goes the
+// blob is marked dead, and reports true so the caller can remove it from
+// storage; a dead blob can't be reserved again until its removal has been
+// confirmed with blobsDeleted.
+func blobUnref(tx *sql.Tx, chk string) (bool, error) {
+	_, err := tx.Exec("UPDATE blobs SET refs = refs - 1 WHERE chk=? AND refs > 0", chk)
+	if err != nil {
+		return false, err
+	}
+	res, err := tx.Exec("UPDATE blobs SET dead=1 WHERE chk=? AND refs=0 AND dead=0", chk)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// blobsReserve takes a reference to a blob on behalf of an upload before it
+// is put in storage, so the blob can't be collected while the upload is in
+// flight. It fails if the blob is dead and waiting to be removed, and reports
+// whether the blob is already stored so the upload can skip putting it.
+func (d *Data) blobsReserve(chk string) (bool, bool) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return false, false
+	}
+	defer tx.Rollback()
+
+	var stored, dead bool
+	err = tx.QueryRow("SELECT stored, dead FROM blobs WHERE chk=?", chk).Scan(&stored, &dead)
+	switch {
+	case err == sql.ErrNoRows:
+		_, err = tx.Exec("INSERT INTO blobs(chk, refs) VALUES(?, 1)", chk)
+	case err != nil:
+		return false, false
+	case dead:
+		return false, false
+	default:
+		_, err = tx.Exec("UPDATE blobs SET refs = refs + 1 WHERE chk=?", chk)
+	}
+	if err != nil {
+		return false, false
+	}
+
+	return tx.Commit() == nil, stored
+}
+
+// blobsRelease gives up a reservation taken by blobsReserve, reporting
+// whether the blob is now dead.
+func (d *Data) blobsRelease(chk string) (bool, bool) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return false, false
+	}
+	defer tx.Rollback()
+
+	dead, err := blobUnref(tx, chk)
+	if err != nil {
+		return false, false
+	}
+
+	return tx.Commit() == nil, dead
+}
+
+// blobsDeleted forgets a dead blob once it has been removed from storage.
+func (d *Data) blobsDeleted(chk string) bool {
+	_, err := d.db.Exec("DELETE FROM blobs WHERE chk=? AND dead=1", chk)
+	return err == nil
+}
+
+type blobState struct {
+	Refs   int
+	Stored bool
+	Dead   bool
+}
+
+// blobsList returns the state of every blob the database knows about,
+// including any checksum referenced by an image without a blobs row.
+func (d *Data) blobsList() (map[string]blobState, error) {
+	rows, err := d.db.Query("SELECT chk, refs, stored, dead FROM blobs UNION SELECT DISTINCT chk, 1, 1, 0 FROM images WHERE chk != '' AND chk NOT IN (SELECT chk FROM blobs)")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	blobs := make(map[string]blobState)
+	for rows.Next() {
+		var chk string
+		var state blobState
+		err = rows.Scan(&chk, &state.Refs, &state.Stored, &state.Dead)
+		if err != nil {
+			return nil, err
+		}
+		blobs[chk] = state
+	}
+	return blobs, rows.Err()
+}
+
+// blobsUnsized returns the stored blobs with no recorded size.
+func (d *Data) blobsUnsized() ([]string, error) {
+	rows, err := d.db.Query("SELECT chk FROM blobs WHERE stored=1 AND dead=0 AND size=0")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var chks []string
+	for rows.Next() {
+		var chk string
+		err = rows.Scan(&chk)
+		if err != nil {
+			return nil, err
+		}
+		chks = append(chks, chk)
+	}
+	return chks, rows.Err()
+}
+
+// blobsSized records the size of a blob that had none.
+func (d *Data) blobsSized(chk string, size int64) bool {
+	_, err := d.db.Exec("UPDATE blobs SET size=? WHERE chk=? AND size=0", size, chk)
+	return err == nil
+}
+
+// nodesJoin records a cluster node's advertised HTTP address.
+func (d *Data) nodesJoin(addr string) bool {
+	_, err := d.db.Exec("INSERT OR IGNORE INTO nodes(addr) VALUES(?)", addr)
+	return err == nil
+}
+
+// blobsHold records that a node holds a copy of a stored blob.
+func (d *Data) blobsHold(chk, node string) bool {
+	_, err := d.db.Exec("INSERT OR IGNORE INTO holders(chk, node) SELECT chk, ? FROM blobs WHERE chk=? AND stored=1 AND dead=0", node, chk)
+	return err == nil
+}
+
+// replicationState returns every known node and, for every live stored
+// blob, the nodes that hold a copy of it.
+func (d *Data) replicationState() ([]string, map[string][]string, error) {
+	rows, err := d.db.Query("SELECT addr FROM nodes ORDER BY addr")
+	if err != nil {
+		return nil, nil, err
+	}
+	var nodes []string
+	for rows.Next() {
+		var addr string
+		err = rows.Scan(&addr)
+		if err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		nodes = append(nodes, addr)
+	}
+	rows.Close()
+
+	rows, err = d.db.Query("SELECT blobs.chk, COALESCE(holders.node, '') FROM blobs LEFT JOIN holders ON blobs.chk = holders.chk WHERE stored=1 AND dead=0")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	holders := make(map[string][]string)
+	for rows.Next() {
+		var chk, node string
+		err = rows.Scan(&chk, &node)
+		if err != nil {
+			return nil, nil, err
+		}
+		if node == "" {
+			holders[chk] = nil
+			continue
+		}
+		holders[chk] = append(holders[chk], node)
+	}
+	return nodes, holders, rows.Err()
+}
+
+// getSetting returns a cluster-wide setting, or an empty string if it has
+// never been set.
+func (d *Data) getSetting(key string) (string, error) {
+	val := ""
+	err := d.db.QueryRow("SELECT val FROM settings WHERE key=?", key).Scan(&val)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return val, err
+}
+
+func (d *Data) setSetting(key, val string) bool {
+	_, err := d.db.Exec("INSERT OR REPLACE INTO settings(key, val) VALUES(?,?)", key, val)
+	return err == nil
+}
+
+const (
+	quotaUser  = "user"
+	quotaGroup = "group"
+	quotaAll   = "*"
+)
+
+var errQuotaExceeded = errors.New("quota exceeded")
+
+type quota struct {
+	Bytes   int64 `json:"bytes"`
+	Objects int64 `json:"objects"`
+}
+
+// getQuota returns the quota for a user or group, falling back to the
+// default quota set for everyone of that kind. Zero limits are unlimited.
+func getQuota(q querier, kind, name string) (quota, error) {
+	var qt quota
+	err := q.QueryRow("SELECT bytes, objects FROM quotas WHERE kind=? AND name IN (?, ?) ORDER BY name = ? LIMIT 1", kind, name, quotaAll, quotaAll).Scan(&qt.Bytes, &qt.Objects)
+	if err == sql.ErrNoRows {
+		return qt, nil
+	}
+	return qt, err
+}
+
+// getUsage returns the bytes and number of images owned by a user or group.
+// The bytes include those held by the images' revisions.
+// Images sharing a blob each count its full size.
+func getUsage(q querier, kind, name string) (quota, error) {
+	column := "own"
+	if kind == quotaGroup {
+		column = "grp"
+	}
+	var usage quota
+	err := q.QueryRow("SELECT COUNT(*), COALESCE(SUM(blobs.size), 0) FROM files JOIN images ON files.id = images.id LEFT JOIN blobs ON images.chk = blobs.chk WHERE files.type='file' AND files."+column+"=?", name).Scan(&usage.Objects, &usage.Bytes)
+	if err != nil {
+		return usage, err
+	}
+	var revs int64
+	err = q.QueryRow("SELECT COALESCE(SUM(blobs.size), 0) FROM revisions JOIN files ON revisions.file = files.id LEFT JOIN blobs ON revisions.chk = blobs.chk WHERE files."+column+"=?", name).Scan(&revs)
+	usage.Bytes += revs
+	return usage, err
+}
+
+// checkQuota fails if a user or group is over quota.
+func checkQuota(q querier, kind, name string) error {
+	qt, err := getQuota(q, kind, name)
+	if err != nil {
+		return err
+	}
+	if qt.Bytes == 0 && qt.Objects == 0 {
+		return nil
+	}
+	usage, err := getUsage(q, kind, name)
+	if err != nil {
+		return err
+	}
+	if (qt.Bytes > 0 && usage.Bytes > qt.Bytes) || (qt.Objects > 0 && usage.Objects > qt.Objects) {
+		return errQuotaExceeded
+	}
+	return nil
+}
+
+func checkQuotas(q querier, owner, group string) error {
+	err := checkQuota(q, quotaUser, owner)
+	if err != nil {
+		return err
+	}
+	return checkQuota(q, quotaGroup, group)
+}
+
+// quotaAllows reports whether a user and group could store another image of
+// the given size, so uploads that can't fit are refused before their data is
+// read. The commit is checked again when it is applied.
+func (d *Data) quotaAllows(owner, group string, size int64) bool {
+	if size < 0 {
+		size = 0
+	}
+	for kind, name := range map[string]string{quotaUser: owner, quotaGroup: group} {
+		qt, err := getQuota(d.db, kind, name)
+		if err != nil {
+			return false
+		}
+		if qt.Bytes == 0 && qt.Objects == 0 {
+			continue
+		}
+		usage, err := getUsage(d.db, kind, name)
+		if err != nil {
+			return false
+		}
+		if (qt.Bytes > 0 && usage.Bytes+size > qt.Bytes) || (qt.Objects > 0 && usage.Objects+1 > qt.Objects) {
+			return false
+		}
+	}
+	return true
+}
+
+func (d *Data) quotasGet(kind, name string) (quota, quota, error) {
+	qt, err := getQuota(d.db, kind, name)
+	if err != nil {
+		return qt, quota{}, err
+	}
+	usage, err := getUsage(d.db, kind, name)
+	return qt, usage, err
+}
+
+// quotasSet sets the quota for a user or group, removing it if both limits
+// are zero.
+func (d *Data) quotasSet(args *quotaArgs) bool {
+	var err error
+	if args.Bytes == 0 && args.Objects == 0 {
+		_, err = d.db.Exec("DELETE FROM quotas WHERE kind=? AND name=?", args.Kind, args.Name)
+	} else {
+		_, err = d.db.Exec("INSERT OR REPLACE INTO quotas(kind, name, bytes, objects) VALUES(?,?,?,?)", args.Kind, args.Name, args.Bytes, args.Objects)
+	}
+	return err == nil
+}
+
+// blobsMeta returns the size of a blob and whatever was recognised about its
+// contents when it was uploaded. The metadata is nil for blobs stored before
+// it was recorded.
+func (d *Data) blobsMeta(chk string) (int64, *blobMeta, error) {
+	var size int64
+	var mime, format, version, arch sql.NullString
+	var vsize sql.NullInt64
+	err := d.db.QueryRow("SELECT size, mime, format, vsize, version, arch FROM blobs LEFT JOIN blobmeta ON blobs.chk = blobmeta.chk WHERE blobs.chk=?", chk).Scan(&size, &mime, &format, &vsize, &version, &arch)
+	if err != nil {
+		return 0, nil, err
+	}
+	if !mime.Valid {
+		return size, nil, nil
+	}
+	return size, &blobMeta{mime.String, format.String, vsize.Int64, version.String, arch.String}, nil
+}
+
+var errBadSearch = errors.New("bad search query")
+
+type searchArgs struct {
+	Query   string
+	Author  string
+	Type    string
+	Labels  map[string]string
+	After   uint64
+	Before  uint64
+	MinSize int64
+	MaxSize int64
+	Sort    string
+	Desc    bool
+	Cursor  *listCursor
+	Reader  *Session
+}
+
+type searchResult struct {
+	Path        string `json:"path"`
+	Type        string `json:"type"`
+	Author      string `json:"author,omitempty"`
+	Description string `json:"description,omitempty"`
+	Checksum    string `json:"checksum,omitempty"`
+	Date        uint64 `json:"date,omitempty"`
+	Size        int64  `json:"size,omitempty"`
+}
+
+const searchPath = "files.path || '/' || files.name"
+
+var searchSorts = map[string]folderSort{
+	"":       {searchPath, false},
+	"path":   {searchPath, false},
+	"name":   {"files.name", false},
+	"date":   {"COALESCE(images.time, 0)", true},
+	"size":   {"COALESCE(blobs.size, 0)", true},
+	"author": {"COALESCE(images.auth, '')", false},
+}
+
+// imagesSearch finds files and folders beneath path/name matching args that
+// args.Reader can read. The full-text query is matched against names,
+// descriptions, authors and labels using SQLite's FTS query syntax. Read
+// permission on the results themselves is checked in the query; results are
+// then passed to visible in order to check the folders above them, and only
+// those it accepts count towards length. Pages continue from args.Cursor,
+// and a cursor is returned for the next page if there were more results.
+// No more than maxSearchScan results are passed to visible for a page, so a
+// page may come back short, or empty, with a cursor to carry on from.
+func (d *Data) imagesSearch(path, name string, args *searchArgs, length int, visible func(string) bool) ([]searchResult, *listCursor, error) {
+	srt, ok := searchSorts[args.Sort]
+	if !ok {
+		return nil, nil, errBadSearch
+	}
+	dir, cmp := " ASC", ">"
+	if args.Desc {
+		dir, cmp = " DESC", "<"
+	}
+
+	clause, vals := descendants(path, name)
+	where := []string{"files.type IN ('file', 'folder')", clause}
+	if !args.Reader.SU {
+		clause, readVals := readableClause(args.Reader)
+		where = append(where, clause)
+		vals = append(vals, readVals...)
+	}
+	if args.Cursor != nil {
+		var key interface{} = args.Cursor.Key
+		if srt.numeric {
+			n, err := strconv.ParseInt(args.Cursor.Key, 10, 64)
+			if err != nil {
+				return nil, nil, errBadCursor
+			}
+			key = n
+		}
+		where = append(where, "("+srt.expr+cmp+"? OR ("+srt.expr+"=? AND "+searchPath+cmp+"?))")
+		vals = append(vals, key, key, args.Cursor.Name)
+	}
+	if args.Query != "" {
+		where = append(where, "files.id IN (SELECT docid FROM search WHERE search MATCH ?)")
+		vals = append(vals, args.Query)
+	}
+	if args.Type != "" {
+		where = append(where, "files.type=?")
+		vals = append(vals, args.Type)
+	}
+	if args.Author != "" {
+		where = append(where, "images.auth=?")
+		vals = append(vals, args.Author)
+	}
+	if args.After > 0 {
+		where = append(where, "images.time>=?")
+		vals = append(vals, args.After)
+	}
+	if args.Before > 0 {
+		where = append(where, "images.time<?")
+		vals = append(vals, args.Before)
+	}
+	if args.MinSize > 0 {
+		where = append(where, "blobs.size>=?")
+		vals = append(vals, args.MinSize)
+	}
+	if args.MaxSize > 0 {
+		where = append(where, "blobs.size<=?")
+		vals = append(vals, args.MaxSize)
+	}
+	for key, val := range args.Labels {
+		where = append(where, "EXISTS (SELECT 1 FROM labels WHERE labels.id = files.id AND key=? AND val=?)")
+		vals = append(vals, key, val)
+	}
+
+	rows, err := d.db.Query("SELECT files.path, files.name, files.type, COALESCE(images.auth, ''), COALESCE(images.desc, ''), COALESCE(images.chk, ''), COALESCE(images.time, 0), COALESCE(blobs.size, 0), "+srt.expr+" FROM files LEFT JOIN images ON images.id = files.id LEFT JOIN blobs ON blobs.chk = images.chk WHERE "+strings.Join(where, " AND ")+" ORDER BY "+srt.expr+dir+", "+searchPath+dir, vals...)
+	if err != nil {
+		if args.Query != "" {
+			return nil, nil, errBadSearch
+		}
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var results []searchResult
+	var key, last string
+	scanned := 0
+	for rows.Next() {
+		if scanned == maxSearchScan {
+			return results, &listCursor{key, last}, nil
+		}
+		scanned++
+		var res searchResult
+		var p, n, k string
+		err = rows.Scan(&p, &n, &res.Type, &res.Author, &res.Description, &res.Checksum, &res.Date, &res.Size, &k)
+		if err != nil {
+			return nil, nil, err
+		}
+		res.Path = p + "/" + n
+		if !visible(res.Path) {
+			key, last = k, res.Path
+			continue
+		}
+		if len(results) == length {
+			return results, &listCursor{key, last}, nil
+		}
+		results = append(results, res)
+		key, last = k, res.Path
+	}
+	err = rows.Err()
+	if err != nil && args.Query != "" {
+		return nil, nil, errBadSearch
+	}
+	return results, nil, err
+}
+
+// readableClause matches files the session can read, going by their own
+// permissions alone.
+func readableClause(s *Session) (string, []interface{}) {
+	user := s.User.Name()
+	groups := s.User.Groups()
+	if len(groups) == 0 {
+		return "(files.own=? AND files.mod&256!=0 OR files.own!=? AND files.mod&4!=0)", []interface{}{user, user}
+	}
+	in := strings.TrimSuffix(strings.Repeat("?,", len(groups)), ",")
+	vals := []interface{}{user, user}
+	for _, grp := range groups {
+		vals = append(vals, grp)
+	}
+	for _, grp := range groups {
+		vals = append(vals, grp)
+	}
+	return "(files.own=? AND files.mod&256!=0 OR files.own!=? AND (files.grp IN (" + in + ") AND files.mod&32!=0 OR files.grp NOT IN (" + in + ") AND files.mod&4!=0))", vals
+}
+
+// ancestorClause matches target and every folder above it.
+func ancestorClause(target string) (string, []interface{}) {
+	var clauses []string
+	var args []interface{}
+	for p := target; p != ""; p, _ = splitPath(p) {
+		path, name := splitPath(p)
+		clauses = append(clauses, "(path=? AND name=?)")
+		args = append(args, path, name)
+	}
+	if len(clauses) == 0 {
+		return "0", nil
+	}
+	return "(" + strings.Join(clauses, " OR ") + ")", args
+}
+
+// imagesSign attaches a signature to the blob an image currently holds.
+func (d *Data) imagesSign(args *signArgs) bool {
+	_, err := d.db.Exec("INSERT OR REPLACE INTO signatures(chk, keyid, pubkey, sig, signer, time) SELECT chk, ?, ?, ?, ?, ? FROM images JOIN files ON images.id = files.id WHERE path=? AND name=? AND chk=?", args.KeyID, args.PublicKey, args.Signature, args.Signer, args.Time, args.Path, args.Name, args.Checksum)
+	return err == nil
+}
+
+func (d *Data) signaturesList(chk string) ([]signaturePL, error) {
+	rows, err := d.db.Query("SELECT keyid, pubkey, sig, signer, time FROM signatures WHERE chk=? ORDER BY time", chk)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sigs := []signaturePL{}
+	for rows.Next() {
+		var sig signaturePL
+		err = rows.Scan(&sig.KeyID, &sig.PublicKey, &sig.Signature, &sig.Signer, &sig.Time)
+		if err != nil {
+			return nil, err
+		}
+		sigs = append(sigs, sig)
+	}
+	return sigs, rows.Err()
+}
+
+// imagesTrust adds a key to, or removes it from, the keys a folder trusts.
+// It fails if the folder doesn't exist, or the key being removed isn't
+// trusted there.
+func (d *Data) imagesTrust(args *trustArgs) bool {
+	var res sql.Result
+	var err error
+	if args.Remove {
+		res, err = d.db.Exec("DELETE FROM trust WHERE keyid=? AND id=(SELECT id FROM files WHERE path=? AND name=? AND type='folder')", args.KeyID, args.Path, args.Name)
+	} else {
+		res, err = d.db.Exec("INSERT OR REPLACE INTO trust(id, keyid, pubkey, name) SELECT id, ?, ?, ? FROM files WHERE path=? AND name=? AND type='folder'", args.KeyID, args.PublicKey, args.KeyName, args.Path, args.Name)
+	}
+	if err != nil {
+		return false
+	}
+	n, err := res.RowsAffected()
+	return err == nil && n > 0
+}
+
+// trustedKeys returns the keys trusted for target. If target is protected,
+// only keys trusted by the highest folder protecting it, or by folders above
+// that, count; otherwise those of every folder above target do.
+func (d *Data) trustedKeys(target string) ([]trustPL, error) {
+	var path, name string
+	clause, args := ancestorClause(target)
+	err := d.db.QueryRow("SELECT files.path, files.name FROM protected JOIN files ON protected.id = files.id WHERE "+clause+" ORDER BY length(files.path) LIMIT 1", args...).Scan(&path, &name)
+	if err == nil {
+		clause, args = ancestorClause(path + "/" + name)
+	} else if err != sql.ErrNoRows {
+		return nil, err
+	}
+	rows, err := d.db.Query("SELECT files.path, files.name, keyid, pubkey, trust.name FROM trust JOIN files ON trust.id = files.id WHERE "+clause+" ORDER BY length(files.path), trust.name", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []trustPL{}
+	for rows.Next() {
+		var key trustPL
+		err = rows.Scan(&path, &name, &key.KeyID, &key.PublicKey, &key.Name)
+		if err != nil {
+			return nil, err
+		}
+		key.Folder = path + "/" + name
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// imagesProtect marks a folder as protected, or clears the mark. It fails if
+// the folder doesn't exist.
+func (d *Data) imagesProtect(args *protectArgs) bool {
+	var res sql.Result
+	var err error
+	if args.Protected {
+		res, err = d.db.Exec("INSERT OR REPLACE INTO protected(id) SELECT id FROM files WHERE path=? AND name=? AND type='folder'", args.Path, args.Name)
+	} else {
+		res, err = d.db.Exec("DELETE FROM protected WHERE id=(SELECT id FROM files WHERE path=? AND name=? AND type='folder')", args.Path, args.Name)
+		if err == nil {
+			// unprotecting a folder that isn't protected is fine
+			var n int
+			err = d.db.QueryRow("SELECT COUNT(*) FROM files WHERE path=? AND name=? AND type='folder'", args.Path, args.Name).Scan(&n)
+			return err == nil && n > 0
+		}
+	}
+	if err != nil {
+		return false
+	}
+	n, err := res.RowsAffected()
+	return err == nil && n > 0
+}
+
+// imagesProtected reports whether target or any folder above it is
+// protected. Errors are treated as protected.
+func (d *Data) imagesProtected(target string) bool {
+	clause, args := ancestorClause(target)
+	count := 0
+	err := d.db.QueryRow("SELECT COUNT(*) FROM protected JOIN files ON protected.id = files.id WHERE "+clause, args...).Scan(&count)
+	return err != nil || count > 0
+}
+
+// registryTags returns the tags in a registry repository, or only those
+// pointing at the manifest chk if it isn't empty.
+func (d *Data) registryTags(repo, chk string) ([]string, error) {
+	query := "SELECT name FROM files JOIN images ON images.id = files.id WHERE path=? AND type='file' AND substr(name, 1, 1) != '.'"
+	args := []interface{}{repo}
+	if chk != "" {
+		query += " AND chk=?"
+		args = append(args, chk)
+	}
+	rows, err := d.db.Query(query+" ORDER BY name", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tags []string
+	for rows.Next() {
+		var tag string
+		err = rows.Scan(&tag)
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	return tags, rows.Err()
+}
+
+// registryRepositories returns the folders holding registry manifests.
+func (d *Data) registryRepositories() ([]string, error) {
+	rows, err := d.db.Query("SELECT path FROM files WHERE name=? AND type='folder' AND path LIKE '/images/%' ORDER BY path", registryManifests)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var repos []string
+	for rows.Next() {
+		var repo string
+		err = rows.Scan(&repo)
+		if err != nil {
+			return nil, err
+		}
+		repos = append(repos, repo)
+	}
+	return repos, rows.Err()
+}
+
+// mirrorSet makes the folder at m.Path mirror m.URL, replacing any mirror it
+// had before.
+func (d *Data) mirrorSet(m *mirror) bool {
+	path, name := splitPath(m.Path)
+	res, err := d.db.Exec("INSERT OR REPLACE INTO mirrors(id, url, kind, interval, own, grp, mod, last) SELECT id, ?, ?, ?, ?, ?, ?, 0 FROM files WHERE path=? AND name=? AND type='folder'", m.URL, m.Kind, m.Interval, m.Owner, m.Group, m.Mode, path, name)
+	if err != nil {
+		return false
+	}
+	n, err := res.RowsAffected()
+	return err == nil && n > 0
+}
+
+// mirrorRemove stops the folder at target mirroring anything.
+func (d *Data) mirrorRemove(target string) bool {
+	path, name := splitPath(target)
+	_, err := d.db.Exec("DELETE FROM mirrors WHERE id=(SELECT id FROM files WHERE path=? AND name=?)", path, name)
+	return err == nil
+}
+
+// mirrorSynced records when a mirror was last synced.
+func (d *Data) mirrorSynced(target string, last int64) bool {
+	path, name := splitPath(target)
+	_, err := d.db.Exec("UPDATE mirrors SET last=? WHERE id=(SELECT id FROM files WHERE path=? AND name=?)", last, path, name)
+	return err == nil
+}
+
+// mirrorClaim moves the last sync of a mirror from seen to now, failing if
+// it no longer is seen, so only one of several nodes racing to sync a
+// mirror wins.
+func (d *Data) mirrorClaim(target string, seen, now int64) bool {
+	path, name := splitPath(target)
+	res, err := d.db.Exec("UPDATE mirrors SET last=? WHERE last=? AND id=(SELECT id FROM files WHERE path=? AND name=?)", now, seen, path, name)
+	if err != nil {
+		return false
+	}
+	n, err := res.RowsAffected()
+	return err == nil && n == 1
+}
+
+const mirrorColumns = "path, name, url, kind, interval, mirrors.own, mirrors.grp, mirrors.mod, last FROM mirrors JOIN files ON mirrors.id = files.id"
+
+func scanMirror(row interface {
+	Scan(dest ...interface{}) error
+}) (*mirror, error) {
+	m := new(mirror)
+	var path, name string
+	err := row.Scan(&path, &name, &m.URL, &m.Kind, &m.Interval, &m.Owner, &m.Group, &m.Mode, &m.Last)
+	if err != nil {
+		return nil, err
+	}
+	m.Path = path + "/" + name
+	return m, nil
+}
+
+// mirrorFor returns the mirror of target or of the nearest folder above it
+// that has one.
+func (d *Data) mirrorFor(target string) (*mirror, error) {
+	clause, args := ancestorClause(target)
+	return scanMirror(d.db.QueryRow("SELECT "+mirrorColumns+" WHERE "+clause+" ORDER BY length(path) DESC LIMIT 1", args...))
+}
+
+// mirrorsList returns every mirror.
+func (d *Data) mirrorsList() ([]mirror, error) {
+	rows, err := d.db.Query("SELECT " + mirrorColumns + " ORDER BY path, name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var mirrors []mirror
+	for rows.Next() {
+		m, err := scanMirror(rows)
+		if err != nil {
+			return nil, err
+		}
+		mirrors = append(mirrors, *m)
+	}
+	return mirrors, rows.Err()
 }
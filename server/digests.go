@@ -0,0 +1,95 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+var (
+	errDigestMismatch  = errors.New("checksum mismatch")
+	errDigestMalformed = errors.New("malformed checksum header")
+	errBlobReference   = errors.New("bad blob reference")
+)
+
+// digests holds the checksums and size of a file computed while it was
+// staged.
+type digests struct {
+	sha256 []byte
+	md5    []byte
+	size   int64
+}
+
+// checksum returns the hex encoded SHA-256 checksum blobs are stored under.
+func (d *digests) checksum() string {
+	return hex.EncodeToString(d.sha256)
+}
+
+// verifyDigests compares the checksums a client claimed for an upload in the
+// X-Checksum-Sha256, Content-MD5 and Digest headers against those computed by
+// the server. Headers that are absent are not checked, and Digest algorithms
+// other than SHA-256 and MD5 are ignored.
+func verifyDigests(h http.Header, d *digests) error {
+	if val := h.Get("X-Checksum-Sha256"); val != "" {
+		sum, err := hex.DecodeString(strings.TrimSpace(val))
+		if err != nil {
+			return errDigestMalformed
+		}
+		if !bytes.Equal(sum, d.sha256) {
+			return errDigestMismatch
+		}
+	}
+
+	if val := h.Get("Content-MD5"); val != "" {
+		sum, err := base64.StdEncoding.DecodeString(strings.TrimSpace(val))
+		if err != nil {
+			return errDigestMalformed
+		}
+		if !bytes.Equal(sum, d.md5) {
+			return errDigestMismatch
+		}
+	}
+
+	for _, header := range h["Digest"] {
+		for _, instance := range strings.Split(header, ",") {
+			x := strings.SplitN(strings.TrimSpace(instance), "=", 2)
+			if len(x) != 2 {
+				return errDigestMalformed
+			}
+			var expected []byte
+			switch strings.ToLower(x[0]) {
+			case "sha-256":
+				expected = d.sha256
+			case "md5":
+				expected = d.md5
+			default:
+				continue
+			}
+			sum, err := base64.StdEncoding.DecodeString(x[1])
+			if err != nil {
+				return errDigestMalformed
+			}
+			if !bytes.Equal(sum, expected) {
+				return errDigestMismatch
+			}
+		}
+	}
+
+	return nil
+}
+
+// parseBlobReference parses a reference of the form "sha256:<hex>" to a blob
+// a client believes is already in storage, returning its checksum.
+func parseBlobReference(ref string) (string, error) {
+	chk := strings.ToLower(strings.TrimPrefix(ref, "sha256:"))
+	if len(chk) != 64 {
+		return "", errBlobReference
+	}
+	if _, err := hex.DecodeString(chk); err != nil {
+		return "", errBlobReference
+	}
+	return chk, nil
+}
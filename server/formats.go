@@ -0,0 +1,155 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// blobMeta describes the contents of a blob, as far as they could be
+// recognised when it was uploaded. VirtualSize is the size of the disk an
+// image describes, which for sparse formats is larger than the blob itself.
+type blobMeta struct {
+	ContentType string
+	Format      string
+	VirtualSize int64
+	Version     string
+	Arch        string
+}
+
+const (
+	sniffLen     = 512
+	isoPVDOffset = 0x8000
+	sectorSize   = 512
+)
+
+var elfMachines = map[uint16]string{
+	0x03: "i386",
+	0x08: "mips",
+	0x14: "ppc",
+	0x15: "ppc64",
+	0x16: "s390x",
+	0x28: "arm",
+	0x3e: "x86_64",
+	0xb7: "aarch64",
+	0xf3: "riscv",
+}
+
+// detectFormat inspects the headers of a staged file to work out its content
+// type and, for disk images and kernels, details of what it contains. It
+// never fails: anything it can't recognise is reported by its sniffed
+// content type alone.
+func detectFormat(path string, size int64) *blobMeta {
+	meta := &blobMeta{ContentType: "application/octet-stream"}
+	file, err := os.Open(path)
+	if err != nil {
+		return meta
+	}
+	defer file.Close()
+
+	head := make([]byte, sniffLen+sectorSize)
+	n, _ := io.ReadFull(file, head)
+	head = head[:n]
+
+	switch {
+	case detectQcow2(head, meta):
+	case detectVMDK(head, meta):
+	case detectELF(head, meta):
+	case detectISO(file, meta):
+	case detectRaw(head, size, meta):
+	default:
+		if len(head) > sniffLen {
+			head = head[:sniffLen]
+		}
+		meta.ContentType = http.DetectContentType(head)
+	}
+	return meta
+}
+
+func detectQcow2(head []byte, meta *blobMeta) bool {
+	if len(head) < 32 || !bytes.Equal(head[:4], []byte("QFI\xfb")) {
+		return false
+	}
+	meta.ContentType = "application/x-qemu-disk"
+	meta.Format = "qcow2"
+	meta.Version = strconv.FormatUint(uint64(binary.BigEndian.Uint32(head[4:8])), 10)
+	meta.VirtualSize = int64(binary.BigEndian.Uint64(head[24:32]))
+	return true
+}
+
+func detectVMDK(head []byte, meta *blobMeta) bool {
+	switch {
+	case len(head) >= 20 && bytes.Equal(head[:4], []byte("KDMV")):
+		// hosted sparse extent
+		meta.Version = strconv.FormatUint(uint64(binary.LittleEndian.Uint32(head[4:8])), 10)
+		meta.VirtualSize = int64(binary.LittleEndian.Uint64(head[12:20])) * sectorSize
+	case bytes.HasPrefix(head, []byte("# Disk DescriptorFile")):
+		// descriptor only, the extents live elsewhere
+	default:
+		return false
+	}
+	meta.ContentType = "application/x-vmdk"
+	meta.Format = "vmdk"
+	return true
+}
+
+func detectELF(head []byte, meta *blobMeta) bool {
+	if len(head) < 20 || !bytes.Equal(head[:4], []byte("\x7fELF")) {
+		return false
+	}
+	var order binary.ByteOrder = binary.LittleEndian
+	if head[5] == 2 {
+		order = binary.BigEndian
+	}
+	meta.ContentType = "application/x-executable"
+	meta.Format = "elf"
+	switch head[4] {
+	case 1:
+		meta.Version = "elf32"
+	case 2:
+		meta.Version = "elf64"
+	}
+	meta.Arch = elfMachines[order.Uint16(head[18:20])]
+	return true
+}
+
+// detectISO looks for the primary volume descriptor of an ISO 9660
+// filesystem, which starts 32KiB into the image.
+func detectISO(file io.ReaderAt, meta *blobMeta) bool {
+	pvd := make([]byte, 136)
+	_, err := file.ReadAt(pvd, isoPVDOffset)
+	if err != nil || pvd[0] != 1 || !bytes.Equal(pvd[1:6], []byte("CD001")) {
+		return false
+	}
+	blocks := int64(binary.LittleEndian.Uint32(pvd[80:84]))
+	blockSize := int64(binary.LittleEndian.Uint16(pvd[128:130]))
+	meta.ContentType = "application/x-iso9660-image"
+	meta.Format = "iso"
+	meta.Version = strconv.Itoa(int(pvd[6]))
+	meta.VirtualSize = blocks * blockSize
+	return true
+}
+
+// detectRaw recognises raw disk images by their MBR boot signature or GPT
+// header.
+func detectRaw(head []byte, size int64, meta *blobMeta) bool {
+	if len(head) < sectorSize {
+		return false
+	}
+	mbr := head[510] == 0x55 && head[511] == 0xaa
+	gpt := len(head) >= sectorSize+8 && bytes.Equal(head[sectorSize:sectorSize+8], []byte("EFI PART"))
+	if !mbr && !gpt {
+		return false
+	}
+	meta.Format = "raw"
+	meta.VirtualSize = size
+	if gpt {
+		meta.Version = "gpt"
+	} else {
+		meta.Version = "mbr"
+	}
+	return true
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultGCInterval = 3600
+	defaultGCGrace    = 86400
+)
+
+/*
+collector periodically reconciles the contents of storage against the blobs
+the database refers to. Blobs nothing refers to are removed once they have
+been seen as orphans for longer than the grace period, dead blobs whose
+removal failed are retried, and referenced blobs missing from storage are
+reported to the journal.
+*/
+type collector struct {
+	lock     sync.Mutex
+	interval time.Duration
+	grace    time.Duration
+	orphans  map[string]time.Time
+	missing  map[string]bool
+}
+
+type fsckPL struct {
+	Orphans []string `json:"orphans"`
+	Missing []string `json:"missing"`
+	Dead    []string `json:"dead"`
+	Deleted []string `json:"deleted,omitempty"`
+}
+
+func (i *Images) setupCollector() {
+	interval := i.s.conf.Storage.GCInterval
+	if interval <= 0 {
+		interval = defaultGCInterval
+	}
+	grace := i.s.conf.Storage.GCGrace
+	if grace <= 0 {
+		grace = defaultGCGrace
+	}
+	i.gc.interval = time.Duration(interval) * time.Second
+	i.gc.grace = time.Duration(grace) * time.Second
+	i.gc.orphans = make(map[string]time.Time)
+	i.gc.missing = make(map[string]bool)
+	go i.collectLoop()
+}
+
+func (i *Images) setupStorageRoutes(r *mux.Router) {
+	r.Handle("/fsck", &ProtectedHandler{i.s, i.fsck}).Methods("GET")
+	r.Handle("/migrate", &ProtectedHandler{i.s, i.migrate}).Methods("POST")
+	r.Handle("/migrate", &ProtectedHandler{i.s, i.migrateStatus}).Methods("GET")
+	r.Handle("/quotas", &ProtectedHandler{i.s, i.quotaSet}).Methods("PUT")
+	r.Handle("/quotas", &ProtectedHandler{i.s, i.quotaUsage}).Methods("GET")
+}
+
+func (i *Images) collectLoop() {
+	ticker := time.NewTicker(i.gc.interval)
+	for range ticker.C {
+		i.runCollector()
+	}
+}
+
+// runCollector runs a single pass of the garbage collector, after pruning
+// expired revisions and sizing blobs stored without a size, recovering from
+// any panic so a failed pass doesn't bring down the server.
+func (i *Images) runCollector() {
+	defer func() {
+		if r := recover(); r != nil {
+			i.log.Error("storage garbage collection failed", "error", r)
+		}
+	}()
+	i.pruneRevisions()
+	i.sizeBlobs()
+	_, err := i.check(false)
+	if err != nil {
+		i.log.Error("storage garbage collection failed", "error", err)
+	}
+}
+
+// check compares storage against the database. Unless dryRun is set it also
+// removes orphans that have outlived the grace period, retries the removal
+// of dead blobs and reports newly missing blobs to the journal.
+func (i *Images) check(dryRun bool) (*fsckPL, error) {
+	i.gc.lock.Lock()
+	defer i.gc.lock.Unlock()
+
+	// list storage before reading the database, since blobs are reserved
+	// before they are stored and so anything listed is already known
+	list, err := i.storage().List()
+	if err != nil {
+		return nil, err
+	}
+	blobs, err := i.s.data.blobsList()
+	if err != nil {
+		return nil, err
+	}
+
+	pl := new(fsckPL)
+	now := time.Now()
+	present := make(map[string]bool)
+	seen := make(map[string]time.Time)
+	for _, chk := range list {
+		present[chk] = true
+		if _, ok := blobs[chk]; ok {
+			continue
+		}
+		pl.Orphans = append(pl.Orphans, chk)
+		first, ok := i.gc.orphans[chk]
+		if !ok {
+			first = now
+		}
+		seen[chk] = first
+		if !dryRun && now.Sub(first) >= i.gc.grace {
+			err = i.storage().Delete(chk)
+			if err != nil {
+				i.log.Error("failed to delete orphaned blob", "checksum", chk, "error", err)
+				continue
+			}
+			delete(seen, chk)
+			pl.Deleted = append(pl.Deleted, chk)
+		}
+	}
+
+	// with replication a node only holds some of the stored blobs, and
+	// those it has yet to fetch aren't missing
+	held := i.heldLocally()
+	for chk, state := range blobs {
+		switch {
+		case state.Dead:
+			pl.Dead = append(pl.Dead, chk)
+		case state.Stored && !present[chk] && (held == nil || held[chk]):
+			pl.Missing = append(pl.Missing, chk)
+		}
+	}
+
+	sort.Strings(pl.Orphans)
+	sort.Strings(pl.Missing)
+	sort.Strings(pl.Dead)
+	if dryRun {
+		return pl, nil
+	}
+
+	i.gc.orphans = seen
+	i.collect(pl.Dead)
+	missing := make(map[string]bool)
+	for _, chk := range pl.Missing {
+		missing[chk] = true
+		if !i.gc.missing[chk] {
+			i.s.journal.serverLog(Error, "STORAGE_MISSING_BLOB", "referenced blob is missing from storage", map[string]string{"checksum": chk})
+		}
+	}
+	i.gc.missing = missing
+	return pl, nil
+}
+
+// fsck reports the differences between storage and the database without
+// changing anything.
+func (i *Images) fsck(s *Session, w http.ResponseWriter, r *http.Request) {
+	pl, err := i.check(true)
+	if err != nil {
+		panic(err)
+	}
+	w.Write(NewSuccessResponse(pl).JSON())
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/alankm/simplicity/server/access"
+	"github.com/gorilla/securecookie"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+type testUser struct {
+	name   string
+	groups []string
+}
+
+func (u *testUser) Name() string {
+	return u.name
+}
+
+func (u *testUser) Groups() []string {
+	return u.groups
+}
+
+func (u *testUser) PrimaryGroup() string {
+	return u.groups[0]
+}
+
+// testSession returns a session for the named user in the given groups. The
+// first group is their primary group.
+func testSession(name string, groups ...string) *Session {
+	return &Session{User: &testUser{name, groups}}
+}
+
+func sha256Hex(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+// testAccess logs in any user it has been given, whatever the password.
+type testAccess map[string]*testUser
+
+func (a testAccess) Login(username, password string) (access.User, error) {
+	u, ok := a[username]
+	if !ok {
+		return nil, errors.New("no such user")
+	}
+	return u, nil
+}
+
+// newTestServer sets up a server on a fresh database and in-memory storage,
+// with the root and /images folders open to everyone. Commands are applied
+// straight to the state machine rather than through raft.
+func newTestServer(t *testing.T) (*Server, func()) {
+	dir, err := ioutil.TempDir("", "vorteil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := new(Server)
+	s.log = log15.New()
+	s.log.SetHandler(log15.DiscardHandler())
+	s.conf.Version = "v1"
+	s.conf.Base = dir
+	s.conf.Advertise = "127.0.0.1:8080"
+	s.conf.Storage.Type = "memory"
+
+	err = s.data.Setup(dir, dir+"/vorteil.db", s.log)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	s.access = make(testAccess)
+	s.web.cookie = securecookie.New(securecookie.GenerateRandomKey(64), securecookie.GenerateRandomKey(32))
+	s.raft.fsm = new(fsm)
+	s.raft.fsm.setup(s)
+	err = s.images.setup(s, s.log)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	open := &Rules{Owner: "server", Group: "server", Mode: 0777}
+	testInsert(t, s, "folder", "", "", open)
+	testInsert(t, s, "folder", "", "images", open)
+
+	return s, func() {
+		s.data.db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func testInsert(t *testing.T, s *Server, ftype, path, name string, r *Rules) {
+	err := s.data.insertFile(ftype, path, name, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testServe runs an images API request for target as the session's user,
+// going through ProtectedHandler's login and permission checks.
+func testServe(t *testing.T, s *Server, sess *Session, method, target string, handler func(*Session, http.ResponseWriter, *http.Request)) *httptest.ResponseRecorder {
+	u := sess.User.(*testUser)
+	s.access.(testAccess)[u.name] = u
+	value, err := s.web.cookie.Encode("vorteil", map[string]string{"username": u.name, "password": ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(method, s.servicesVersionString()+target, nil)
+	r.AddCookie(&http.Cookie{Name: "vorteil", Value: value})
+	(&ProtectedHandler{s, handler}).ServeHTTP(w, r)
+	return w
+}
+
+// testUpload commits data as a new image at target owned by the session.
+func testUpload(t *testing.T, s *Server, sess *Session, target, data string) {
+	ul := &uploadData{
+		Owner:   sess.User.Name(),
+		Group:   sess.User.PrimaryGroup(),
+		Mode:    0644,
+		Target:  target,
+		Parents: true,
+		Now:     1,
+	}
+	r := &http.Request{Header: make(http.Header), Body: ioutil.NopCloser(strings.NewReader(data))}
+	err := s.images.load(sess, r, ul)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ul.Reserved = true
+	ul.Node = s.conf.Advertise
+	err = s.images.apply("imagesUpload", ul)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testGet runs an images API GET request for target through handler.
+func testGet(s *Server, sess *Session, handler func(*Session, http.ResponseWriter, *http.Request), target string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", s.servicesVersionString()+target, nil)
+	handler(sess, w, r)
+	return w
+}
@@ -1,13 +1,18 @@
 package server
 
 import (
+	"crypto/md5"
 	"crypto/sha256"
-	"encoding/hex"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"gopkg.in/inconshreveable/log15.v2"
@@ -16,74 +21,169 @@ import (
 type Images struct {
 	s       *Server
 	log     log15.Logger
-	Storage storage
+	active  backend
+	uploads uploads
+	gc      collector
+	repl    replicator
+	migr    migration
+	quotas  quotaWarnings
+	mirr    mirrorer
 }
 
 func (i *Images) setup(s *Server, log log15.Logger) error {
-	log.Debug("HAI")
 	i.s = s
 	i.log = log
-	var err error
-	i.Storage, err = initStorage(i.s.conf.Storage)
+	err := i.loadActiveStorage()
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(i.tmpDir(), 0755)
 	if err != nil {
-		i.log.Debug("HAI")
 		return err
 	}
+	err = i.setupUploads()
+	if err != nil {
+		return err
+	}
+	i.setupCollector()
+	i.setupMirrors()
 	i.log.Debug("images setup")
+	return nil
+}
+
+// tmpDir is where request bodies are staged before being committed to
+// storage.
+func (i *Images) tmpDir() string {
+	return i.s.conf.Base + "/tmp"
 }
 
 func (i *Images) setupRoutes(r *mux.Router) {
+	r.Handle("/{path:.*}", &ProtectedHandler{i.s, i.uploadStart}).Methods("POST").Queries("upload", "start")
+	r.Handle("/{path:.*}", &ProtectedHandler{i.s, i.uploadFinish}).Methods("POST").Queries("upload", "{id}")
+	r.Handle("/{path:.*}", &ProtectedHandler{i.s, i.uploadChunk}).Methods("PATCH").Queries("upload", "{id}")
+	r.Handle("/{path:.*}", &ProtectedHandler{i.s, i.uploadProgress}).Methods("HEAD").Queries("upload", "{id}")
+	r.Handle("/{path:.*}", &ProtectedHandler{i.s, i.uploadAbort}).Methods("DELETE").Queries("upload", "{id}")
+	r.Handle("/{path:.*}", &ProtectedHandler{i.s, i.move}).Methods("POST").Queries("move", "{dest}")
+	r.Handle("/{path:.*}", &ProtectedHandler{i.s, i.copy}).Methods("POST").Queries("copy", "{dest}")
+	r.Handle("/{path:.*}", &ProtectedHandler{i.s, i.mkdir}).Methods("POST").Queries("folder", "true")
+	r.Handle("/{path:.*}", &ProtectedHandler{i.s, i.syncNow}).Methods("POST").Queries("sync", "true")
+	r.Handle("/{path:.*}", &ProtectedHandler{i.s, i.uploadArchive}).Methods("POST").Queries("archive", "{format}")
+	r.Handle("/{path:.*}", &ProtectedHandler{i.s, i.sign}).Methods("POST").Queries("signature", "true")
 	r.Handle("/{path:.*}", &ProtectedHandler{i.s, i.postOW}).Methods("POST").Queries("overwrite", "true")
 	r.Handle("/{path:.*}", &ProtectedHandler{i.s, i.post}).Methods("POST")
 	r.Handle("/{path:.*}", &ProtectedHandler{i.s, i.putAttr}).Methods("PUT").Queries("attributes", "true")
+	r.Handle("/{path:.*}", &ProtectedHandler{i.s, i.chmod}).Methods("PUT").Queries("mode", "{mode}")
+	r.Handle("/{path:.*}", &ProtectedHandler{i.s, i.chmod}).Methods("PUT").Queries("owner", "{owner}")
+	r.Handle("/{path:.*}", &ProtectedHandler{i.s, i.chmod}).Methods("PUT").Queries("group", "{group}")
+	r.Handle("/{path:.*}", &ProtectedHandler{i.s, i.rollback}).Methods("PUT").Queries("rollback", "{rev}")
+	r.Handle("/{path:.*}", &ProtectedHandler{i.s, i.trust}).Methods("PUT").Queries("trust", "{name}")
+	r.Handle("/{path:.*}", &ProtectedHandler{i.s, i.protect}).Methods("PUT").Queries("protected", "{protected}")
+	r.Handle("/{path:.*}", &ProtectedHandler{i.s, i.setMirror}).Methods("PUT").Queries("mirror", "{url}")
 	r.Handle("/{path:.*}", &ProtectedHandler{i.s, i.putOW}).Methods("PUT")
 	r.Handle("/{path:.*}", &ProtectedHandler{i.s, i.readAttr}).Methods("GET").Queries("attributes", "true")
-	r.Handle("/{path:.*}", &ProtectedHandler{i.s, i.read}).Methods("GET")
+	r.Handle("/{path:.*}", &ProtectedHandler{i.s, i.listRevisions}).Methods("GET").Queries("revisions", "true")
+	r.Handle("/{path:.*}", &ProtectedHandler{i.s, i.listSignatures}).Methods("GET").Queries("signatures", "true")
+	r.Handle("/{path:.*}", &ProtectedHandler{i.s, i.verify}).Methods("GET").Queries("verify", "true")
+	r.Handle("/{path:.*}", &ProtectedHandler{i.s, i.presign}).Methods("GET").Queries("presign", "{secs}")
+	r.Handle("/{path:.*}", &ProtectedHandler{i.s, i.listTrusted}).Methods("GET").Queries("trusted", "true")
+	r.Handle("/{path:.*}", &ProtectedHandler{i.s, i.getMirror}).Methods("GET").Queries("mirror", "true")
+	r.Handle("/{path:.*}", &ProtectedHandler{i.s, i.search}).Methods("GET").Queries("search", "{query}")
+	r.Handle("/{path:.*}", &ProtectedHandler{i.s, i.downloadArchive}).Methods("GET").Queries("archive", "{format}")
+	r.Handle("/{path:.*}", &ProtectedHandler{i.s, i.findLabels}).Methods("GET").Queries("label", "{label}")
+	r.Handle("/{path:.*}", &ProtectedHandler{i.s, i.resolveTag}).Methods("GET", "HEAD").Queries("tag", "{tag}")
+	r.Handle("/{path:.*}", &ProtectedHandler{i.s, i.readRevision}).Methods("GET", "HEAD").Queries("revision", "{rev}")
+	r.Handle("/{path:.*}", &ProtectedHandler{i.s, i.read}).Methods("GET", "HEAD")
+	r.Handle("/{path:.*}", &ProtectedHandler{i.s, i.untrust}).Methods("DELETE").Queries("trust", "{key}")
+	r.Handle("/{path:.*}", &ProtectedHandler{i.s, i.removeMirror}).Methods("DELETE").Queries("mirror", "true")
 	r.Handle("/{path:.*}", &ProtectedHandler{i.s, i.delete}).Methods("DELETE")
 }
 
-func (i *Images) load(s *Session, r *http.Request) string {
-	// Load body of request and commit to storage.
-	file, err := ioutil.TempFile(i.vorteil.config.Data+"/tmp", "img")
+// load stages the body of the request and commits it to storage, recording
+// its checksum, size and metadata in ul.
+func (i *Images) load(s *Session, r *http.Request, ul *uploadData) error {
+	tmp, sums, err := i.stage(r.Body)
 	if err != nil {
-		i.vorteil.log.Error("vimages couldn't create temporary file")
+		i.log.Error("couldn't stage uploaded file", "error", err)
 		panic(CodeInternal)
 	}
-
-	sha := sha256.New()
-	mw := io.MultiWriter(sha, file)
-
-	_, err = io.Copy(mw, r.Body)
+	err = verifyDigests(r.Header, sums)
 	if err != nil {
-		i.vorteil.log.Error("vimages couldn't copy file")
-		panic(CodeInternal)
+		os.Remove(tmp)
+		return err
 	}
-
-	file.Close()
-	checksum := hex.EncodeToString(sha.Sum(nil))
-
-	// Commit loaded file to storage
-	var uniq = true
-	list, err := i.images.Storage.List()
+	ul.Checksum = sums.checksum()
+	ul.Size = sums.size
+	ul.Meta = detectFormat(tmp, sums.size)
+	err = i.store(tmp, ul.Checksum)
 	if err != nil {
-		i.vorteil.log.Error("vimages failed to find files in storage")
 		panic(CodeInternal)
 	}
+	return nil
+}
 
-	for _, str := range list {
-		if str == checksum {
-			uniq = false
-			break
+// reference resolves an upload by reference to a blob that is already in
+// storage, so the client doesn't need to send its bytes again. The session
+// must be able to read an image, or revision of one, holding the blob, so a
+// checksum alone doesn't grant access to contents. Whether the blob really is
+// stored is checked when the image is committed.
+func (i *Images) reference(s *Session, ref string) (string, error) {
+	chk, err := parseBlobReference(ref)
+	if err != nil {
+		return "", err
+	}
+	targets, err := i.s.data.blobHolders(chk)
+	if err != nil {
+		panic(err)
+	}
+	for _, target := range targets {
+		if i.s.CanReadFile(s, target) {
+			return chk, nil
 		}
 	}
+	return "", errAccessDenied
+}
 
-	err = i.images.Storage.Put(checksum, file.Name())
+// stage copies src into a temporary file, returning the file's name and the
+// checksums of its contents.
+func (i *Images) stage(src io.Reader) (string, *digests, error) {
+	file, err := ioutil.TempFile(i.tmpDir(), "img")
 	if err != nil {
-		i.vorteil.log.Error("vimages failed to commit file to storage")
-		panic(CodeInternal)
+		return "", nil, err
 	}
+	defer file.Close()
 
-	return checksum
+	sha := sha256.New()
+	sum := md5.New()
+	mw := io.MultiWriter(sha, sum, file)
+
+	size, err := io.Copy(mw, src)
+	if err != nil {
+		os.Remove(file.Name())
+		return "", nil, err
+	}
+
+	return file.Name(), &digests{sha.Sum(nil), sum.Sum(nil), size}, nil
+}
+
+// store commits a staged file to storage under its checksum, holding a
+// reservation on the blob that the caller must hand over to an image or
+// release. If this node already holds the blob the staged file is discarded.
+func (i *Images) store(tmp, checksum string) error {
+	stored, err := i.reserve(checksum)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if stored && i.holds(checksum) {
+		return os.Remove(tmp)
+	}
+	err = i.storage().Put(checksum, tmp)
+	if err != nil {
+		i.log.Error("failed to commit file to storage", "checksum", checksum, "error", err)
+		i.release(checksum)
+		return err
+	}
+	return nil
 }
 
 type uploadData struct {
@@ -91,6 +191,7 @@ type uploadData struct {
 	Group       string
 	Mode        uint16
 	Target      string
+	Parents     bool
 	Author      string
 	AuthSet     bool
 	Description string
@@ -98,6 +199,16 @@ type uploadData struct {
 	Time        uint64
 	TimeSet     bool
 	Checksum    string
+	Reserved    bool
+	Node        string
+	Size        int64
+	KeepLast    int
+	KeepDays    int
+	Now         int64
+	Labels      map[string]string
+	Tags        map[string]int
+	Untags      []string
+	Meta        *blobMeta
 }
 
 func (i *Images) makeUploadStruct(s *Session, r *http.Request) *uploadData {
@@ -105,29 +216,30 @@ func (i *Images) makeUploadStruct(s *Session, r *http.Request) *uploadData {
 	ret.Owner = s.User.Name()
 	ret.Group = s.User.PrimaryGroup()
 	ret.Mode = s.Mode()
-	ret.Target = strings.TrimPrefix(r.URL.Path, i.s.servicesVersionString())
-	if val, ok := r.Header["Author"]; ok {
-		ret.AuthSet = true
-		ret.Author = val
-	}
-	if val, ok := r.Header["Description"]; ok {
+	ret.Target = strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, i.s.servicesVersionString()), "/")
+	ret.Parents = r.URL.Query().Get("parents") == "true"
+	if val, ok := r.Header["Author"]; ok && len(val) > 0 {
 		ret.AuthSet = true
-		ret.Author = val
+		ret.Author = val[0]
 	}
-	if val, ok := r.Header["Time"]; ok {
-		ret.AuthSet = true
-		ret.Author = val
+	if val, ok := r.Header["Description"]; ok && len(val) > 0 {
+		ret.DescSet = true
+		ret.Description = val[0]
 	}
-	ret.Checksum = i.load(s, r)
-	if err != nil {
-		return nil
+	if val, ok := r.Header["Time"]; ok && len(val) > 0 {
+		t, err := strconv.ParseUint(val[0], 10, 64)
+		if err == nil {
+			ret.TimeSet = true
+			ret.Time = t
+		}
 	}
 	return ret
 }
 
 type uploadRet struct {
 	Ok     bool
-	Delete string
+	Quota  bool
+	Delete []string
 }
 
 func (i *Images) uploadOWFSM(data []byte) interface{} {
@@ -137,7 +249,9 @@ func (i *Images) uploadOWFSM(data []byte) interface{} {
 	if err != nil {
 		return ret
 	}
-	ret.Ok, ret.Delete = i.s.data.imagesOverwrite(args)
+	ret.Delete, err = i.s.data.imagesOverwrite(args)
+	ret.Ok = err == nil
+	ret.Quota = err == errQuotaExceeded
 	return ret
 }
 
@@ -148,7 +262,20 @@ func (i *Images) uploadFSM(data []byte) interface{} {
 	if err != nil {
 		return ret
 	}
-	ret.Ok, ret.Delete = i.s.data.imagesAdd(args)
+	ret.Delete, err = i.s.data.imagesAdd(args)
+	ret.Ok = err == nil
+	ret.Quota = err == errQuotaExceeded
+	return ret
+}
+
+func (i *Images) mkdirFSM(data []byte) interface{} {
+	args := new(uploadData)
+	ret := new(uploadRet)
+	err := decode(data, args)
+	if err != nil {
+		return ret
+	}
+	ret.Ok = i.s.data.imagesMkdir(args)
 	return ret
 }
 
@@ -163,34 +290,100 @@ func (i *Images) attributesFSM(data []byte) interface{} {
 	return ret
 }
 
-func (i *Images) postOW(s *Session, w http.ResponseWriter, r *http.Request) {
+// upload loads the body of the request into storage, or resolves the blob it
+// references, and commits the image described by ul using the named FSM
+// function.
+func (i *Images) upload(s *Session, w http.ResponseWriter, r *http.Request, fn string) {
 	ul := i.makeUploadStruct(s, r)
-	ret := i.s.sync("imagesUploadOW", ul)
-	r := ret.(uploadRet)
-	r := ret.(imgDeleteRet)
-	//
-	if !r.Ok {
+	if !strings.HasPrefix(ul.Target, "/images/") {
+		w.Write(ResponseAccessDenied.JSON())
+		return
+	}
+	if !i.s.data.quotaAllows(ul.Owner, ul.Group, r.ContentLength) {
+		w.Write(ResponseQuotaExceeded.JSON())
+		return
+	}
+	var err error
+	if ref := r.URL.Query().Get("blob"); ref != "" {
+		ul.Checksum, err = i.reference(s, ref)
+	} else {
+		err = i.load(s, r, ul)
+		ul.Reserved = err == nil
+		ul.Node = i.s.conf.Advertise
+	}
+	if err != nil {
+		w.Write(NewFailResponse(0, err.Error()).JSON())
+		return
+	}
+	i.commit(w, fn, ul)
+}
+
+// commit syncs a staged image described by ul using the named FSM function
+// and writes the response.
+func (i *Images) commit(w http.ResponseWriter, fn string, ul *uploadData) {
+	// retention is decided here rather than when the command is applied, so
+	// every node prunes the same revisions, and not when the upload started,
+	// since a resumable upload may be committed long after
+	ul.KeepLast = i.s.conf.Storage.Revisions.KeepLast
+	ul.KeepDays = i.s.conf.Storage.Revisions.KeepDays
+	ul.Now = time.Now().Unix()
+	err := i.apply(fn, ul)
+	if err == errQuotaExceeded {
+		w.Write(ResponseQuotaExceeded.JSON())
+		return
+	}
+	if err != nil {
 		w.Write(NewFailResponse(0, "").JSON())
 		return
 	}
-	//
-	if r.Delete != "" {
-		err := i.Storage.Delete(r.Delete)
-		if err != nil {
-			panic(err)
+	w.Write(NewSuccessResponse(nil).JSON())
+}
+
+var errCommit = errors.New("commit failed")
+
+// apply syncs a staged image described by ul using the named FSM function.
+// On failure any reservation the upload holds is released; on success blobs
+// the change left unreferenced are collected.
+func (i *Images) apply(fn string, ul *uploadData) error {
+	ret := i.s.sync(fn, ul)
+	x, ok := ret.(*uploadRet)
+	if !ok || !x.Ok {
+		if ul.Reserved {
+			i.release(ul.Checksum)
+		}
+		if ok && x.Quota {
+			return errQuotaExceeded
 		}
+		return errCommit
 	}
+	if len(x.Delete) > 0 {
+		i.collect(x.Delete)
+	}
+	i.warnQuotas(ul.Owner, ul.Group)
+	return nil
+}
 
-	w.Write(NewSuccessResponse(nil).JSON())
+func (i *Images) postOW(s *Session, w http.ResponseWriter, r *http.Request) {
+	i.upload(s, w, r, "imagesUploadOW")
 }
 
 func (i *Images) post(s *Session, w http.ResponseWriter, r *http.Request) {
+	i.upload(s, w, r, "imagesUpload")
+}
+
+func (i *Images) putOW(s *Session, w http.ResponseWriter, r *http.Request) {
+	i.upload(s, w, r, "imagesUploadOW")
+}
+
+func (i *Images) mkdir(s *Session, w http.ResponseWriter, r *http.Request) {
 	ul := i.makeUploadStruct(s, r)
-	ret := i.s.sync("imagesUploadOW", ul)
-	r := ret.(uploadRet)
-	r := ret.(imgDeleteRet)
-	//
-	if !r.Ok {
+	if !strings.HasPrefix(ul.Target, "/images/") {
+		w.Write(ResponseAccessDenied.JSON())
+		return
+	}
+	ret := i.s.sync("imagesMkdir", ul)
+	x, ok := ret.(*uploadRet)
+	if !ok || !x.Ok {
 		w.Write(NewFailResponse(0, "").JSON())
 		return
 	}
@@ -199,154 +392,313 @@ func (i *Images) post(s *Session, w http.ResponseWriter, r *http.Request) {
 
 func (i *Images) putAttr(s *Session, w http.ResponseWriter, r *http.Request) {
 	ul := i.makeUploadStruct(s, r)
-	ret := i.s.sync("imagesAttrOW", ul)
-	r := ret.(uploadRet)
-	r := ret.(imgDeleteRet)
-	//
-	if !r.Ok {
-		w.Write(NewFailResponse(0, "").JSON())
+	err := parseLabels(r.Header, ul)
+	if err != nil {
+		w.Write(NewFailResponse(0, err.Error()).JSON())
 		return
 	}
-	w.Write(NewSuccessResponse(nil).JSON())
-}
-
-func (i *Images) putOW(s *Session, w http.ResponseWriter, r *http.Request) {
-	ul := i.makeUploadStruct(s, r)
-	ret := i.s.sync("imagesUploadOW", ul)
-	r := ret.(uploadRet)
-	r := ret.(imgDeleteRet)
-	//
-	if !r.Ok {
-		w.Write(NewFailResponse(0, "").JSON())
+	if !i.canMoveTags(s, ul) {
+		w.Write(ResponseAccessDenied.JSON())
 		return
 	}
-	//
-	if r.Delete != "" {
-		err := i.Storage.Delete(r.Delete)
-		if err != nil {
-			panic(err)
-		}
+	ret := i.s.sync("imagesAttrOW", ul)
+	x, ok := ret.(*uploadRet)
+	if !ok || !x.Ok {
+		w.Write(NewFailResponse(0, "").JSON())
+		return
 	}
-
 	w.Write(NewSuccessResponse(nil).JSON())
 }
 
 type attrPL struct {
-	Name        string `json:"name"`
-	Author      string `json:"author"`
-	Description string `json:"description"`
-	Checksum    string `json:"checksum"`
-	Date        uint64 `json:"date"`
+	Name        string            `json:"name"`
+	Author      string            `json:"author"`
+	Description string            `json:"description"`
+	Checksum    string            `json:"checksum"`
+	Date        uint64            `json:"date"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Tags        []tagPL           `json:"tags,omitempty"`
+	Size        int64             `json:"size"`
+	ContentType string            `json:"contentType,omitempty"`
+	Format      string            `json:"format,omitempty"`
+	VirtualSize int64             `json:"virtualSize,omitempty"`
+	Version     string            `json:"version,omitempty"`
+	Arch        string            `json:"arch,omitempty"`
 }
 
 func (i *Images) readAttr(s *Session, w http.ResponseWriter, r *http.Request) {
 	pl := new(attrPL)
 	path, name := splitPath(strings.TrimPrefix(r.URL.Path, i.s.servicesVersionString()))
 	pl.Name = name
-	pl.Author, pl.Description, pl.Date, pl.Checksum, _ = i.s.data.imagesGetAttributes(path, name)
+	var err error
+	pl.Author, pl.Description, pl.Date, pl.Checksum, err = i.s.data.imagesGetAttributes(path, name)
+	if err != nil {
+		w.Write(NewFailResponse(0, "no such file").JSON())
+		return
+	}
+	pl.Labels, err = i.s.data.imagesLabels(path, name)
+	if err != nil {
+		panic(err)
+	}
+	pl.Tags, err = i.s.data.imagesTags(path, name)
+	if err != nil {
+		panic(err)
+	}
+	if pl.Checksum != "" {
+		var meta *blobMeta
+		pl.Size, meta, err = i.s.data.blobsMeta(pl.Checksum)
+		if err == nil && meta != nil {
+			pl.ContentType = meta.ContentType
+			pl.Format = meta.Format
+			pl.VirtualSize = meta.VirtualSize
+			pl.Version = meta.Version
+			pl.Arch = meta.Arch
+		}
+	}
 	w.Write(NewSuccessResponse(pl).JSON())
 }
 
 func (i *Images) read(s *Session, w http.ResponseWriter, r *http.Request) {
 	path, name := splitPath(strings.TrimPrefix(r.URL.Path, i.s.servicesVersionString()))
-	chk := i.s.data.imagesGetInfo(path, name)
+	chk, err := i.s.data.imagesGetInfo(path, name)
+	if err != nil {
+		if !i.pullThrough(w, r, path+"/"+name) {
+			w.Write(NewFailResponse(0, "no such file").JSON())
+		}
+		return
+	}
 	if chk == "folder" {
 		// return list of children
 		i.readFolder(s, w, r)
-	} else {
-		// return image file
-		file, err := i.Storage.Get(chk)
-		if err != nil {
-			panic(err)
-		}
-		io.Copy(w, file)
 		return
 	}
+	// return image file
+	_, _, date, _, err := i.s.data.imagesGetAttributes(path, name)
+	if err != nil {
+		panic(err)
+	}
+	i.deliver(w, r, path+"/"+name, chk, date)
+}
+
+// deliver serves the blob chk as the contents of the image at target, as
+// long as this node holds it and, if the image is in a protected folder, it
+// carries a trusted signature.
+func (i *Images) deliver(w http.ResponseWriter, r *http.Request, target, chk string, date uint64) {
+	if !i.holds(chk) {
+		w.Write(ResponseNotReplicated.JSON())
+		return
+	}
+	if i.s.data.imagesProtected(target) && !i.verified(target, chk) {
+		w.Write(ResponseUnsigned.JSON())
+		return
+	}
+	_, name := splitPath(target)
+	i.serve(w, r, name, chk, date)
+}
+
+// serve writes the blob chk to w. Blobs are content addressed, so the
+// checksum doubles as a strong ETag, and http.ServeContent takes care of
+// conditional, range and multi-range requests.
+func (i *Images) serve(w http.ResponseWriter, r *http.Request, name, chk string, date uint64) {
+	file, err := i.storage().Get(chk)
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+
+	var modtime time.Time
+	if date != 0 {
+		modtime = time.Unix(int64(date), 0)
+	}
+	if _, meta, err := i.s.data.blobsMeta(chk); err == nil && meta != nil {
+		w.Header().Set("Content-Type", meta.ContentType)
+	}
+	w.Header().Set("ETag", "\""+chk+"\"")
+	http.ServeContent(w, r, name, modtime, file)
 }
 
 type folderPL struct {
 	Name string `json:"name"`
 	Type string `json:"type"`
+	*longPL
+}
+
+// longPL holds the extra details of each child in a long listing.
+type longPL struct {
+	Owner       string `json:"owner"`
+	Group       string `json:"group"`
+	Mode        uint16 `json:"mode"`
+	Author      string `json:"author,omitempty"`
+	Description string `json:"description,omitempty"`
+	Date        uint64 `json:"date,omitempty"`
+	Checksum    string `json:"checksum,omitempty"`
+	Size        int64  `json:"size,omitempty"`
 }
 
 type shortPL struct {
 	Length int        `json:"length"`
 	List   []folderPL `json:"list"`
+	Next   string     `json:"next,omitempty"`
+}
+
+const (
+	defaultFolderLength = 100
+	maxFolderLength     = 1000
+)
+
+var (
+	ResponseBadSort   = NewFailResponse(0, "bad sort")
+	ResponseBadCursor = NewFailResponse(0, "bad cursor")
+
+	errBadSort = errors.New("bad sort")
+)
+
+type listArgs struct {
+	Filter string
+	Sort   string
+	Desc   bool
+	Length int
+	Cursor *listCursor
+	Long   bool
+}
+
+// listCursor marks where a page of a folder listing ended.
+type listCursor struct {
+	Key  string `json:"k"`
+	Name string `json:"n"`
+}
+
+func encodeCursor(c *listCursor) string {
+	data, err := json.Marshal(c)
+	if err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(s string) (*listCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errBadCursor
+	}
+	c := new(listCursor)
+	err = json.Unmarshal(data, c)
+	if err != nil {
+		return nil, errBadCursor
+	}
+	return c, nil
 }
 
+// readFolder lists the children of a folder. They can be filtered by a
+// substring of their name, sorted by name, type, date, size or author in
+// either order, and paged through by passing the next cursor of one page as
+// the cursor of the next. A long listing includes each child's rules and
+// attributes.
 func (i *Images) readFolder(s *Session, w http.ResponseWriter, r *http.Request) {
-	var err error
-	path, name := splitPath(strings.TrimPrefix(r.URL.Path, i.s.servicesVersionString()))
-	off := 0
-	if val, ok := r.URL.Query()["offset"]; ok {
-		off, err = strconv.ParseInt(val, 10, 32)
-		if err != nil {
-			off = 0
+	q := r.URL.Query()
+	path, name := splitPath(strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, i.s.servicesVersionString()), "/"))
+	args := &listArgs{
+		Filter: q.Get("filter"),
+		Sort:   strings.ToLower(q.Get("sort")),
+		Desc:   strings.ToLower(q.Get("order")) == "desc",
+		Length: defaultFolderLength,
+		Long:   q.Get("long") == "true",
+	}
+	if args.Sort == "" {
+		args.Sort = "name"
+	}
+	if val := q.Get("length"); val != "" {
+		n, err := strconv.Atoi(val)
+		if err != nil || n <= 0 {
+			w.Write(NewFailResponse(0, "bad length").JSON())
+			return
 		}
+		args.Length = n
 	}
-
-	len := -1
-	if val, ok := r.URL.Query()["length"]; ok {
-		len, err = strconv.ParseInt(val, 10, 32)
+	if args.Length > maxFolderLength {
+		args.Length = maxFolderLength
+	}
+	if val := q.Get("cursor"); val != "" {
+		var err error
+		args.Cursor, err = decodeCursor(val)
 		if err != nil {
-			len = -1
+			w.Write(ResponseBadCursor.JSON())
+			return
 		}
 	}
 
-	fltr := ""
-	if val, ok := r.URL.Query()["filter"]; ok {
-		fltr = val
-	}
-
-	srt := ""
-	if val, ok := r.URL.Query()["sort"]; ok {
-		// TODO: alternate sortings
+	pl, err := i.s.data.imagesGetFolder(path, name, args)
+	switch err {
+	case nil:
+	case errBadSort:
+		w.Write(ResponseBadSort.JSON())
+		return
+	case errBadCursor:
+		w.Write(ResponseBadCursor.JSON())
+		return
+	default:
+		panic(err)
 	}
-
-	ord := "DESC"
-	if val, ok := r.URL.Query()["order"]; ok && val == "ASC" {
-		ord = val
+	if args.Long {
+		i.redactListing(s, path+"/"+name, pl)
 	}
-
-	pl := i.s.data.imagesGetFolder(path, name, fltr, srt, ord, off, len)
 	w.Write(NewSuccessResponse(pl).JSON())
+}
 
+// redactListing clears the details of the children in a long listing of
+// folder that the session couldn't read for itself, leaving only what ls -l
+// would show of them.
+func (i *Images) redactListing(s *Session, folder string, pl *shortPL) {
+	traverse := i.s.CanExecFile(s, folder)
+	for _, f := range pl.List {
+		l := f.longPL
+		if traverse && s.CanRead(&Rules{l.Owner, l.Group, l.Mode}) {
+			continue
+		}
+		l.Author = ""
+		l.Description = ""
+		l.Date = 0
+		l.Checksum = ""
+		l.Size = 0
+	}
 }
 
 type imgDeleteArgs struct {
-	Target string
+	Target    string
+	Recursive bool
 }
 
 type imgDeleteRet struct {
 	Ok       bool
-	Delete   string
+	Delete   []string
 	Response string
 }
 
 func (i *Images) delete(s *Session, w http.ResponseWriter, r *http.Request) {
 	target := strings.TrimPrefix(r.URL.Path, i.s.servicesVersionString())
-	ret := i.s.sync("imagesDelete", &imgDeleteArgs{target})
-	r := ret.(imgDeleteRet)
-	//
-	if !r.Ok {
-		w.Write(NewFailResponse(0, "").JSON())
+	if path, _ := splitPath(target); path == "" {
+		w.Write(ResponseAccessDenied.JSON())
 		return
 	}
-	//
-	if r.Delete != "" {
-		err := i.Storage.Delete(r.Delete)
-		if err != nil {
-			panic(err)
-		}
+	recursive := r.URL.Query().Get("recursive") == "true"
+	if recursive && !i.s.CanRecursiveFile(s, target) {
+		w.Write(ResponseAccessDenied.JSON())
+		return
+	}
+	ret := i.s.sync("imagesDelete", &imgDeleteArgs{target, recursive})
+	x, ok := ret.(*imgDeleteRet)
+	if !ok || !x.Ok {
+		w.Write(NewFailResponse(0, "").JSON())
+		return
 	}
-	//
-	switch r.Response {
+	i.collect(x.Delete)
+	switch x.Response {
 	case "SUCCESS":
 		w.Write(NewSuccessResponse(nil).JSON())
 	case "RECURSION":
 		w.Write(NewFailResponse(0, "can't delete without recursion").JSON())
 	default:
-		panic(err)
+		w.Write(ResponseVorteilInternal.JSON())
 	}
 }
 
@@ -359,7 +711,7 @@ func (i *Images) deleteFSM(data []byte) interface{} {
 	}
 
 	path, name := splitPath(args.Target)
-	if i.s.data.hasChildren(path, name) {
+	if !args.Recursive && i.s.data.hasChildren(path, name) {
 		ret.Ok = true
 		ret.Response = "RECURSION"
 		return ret
@@ -375,3 +727,182 @@ func (i *Images) deleteFSM(data []byte) interface{} {
 	return ret
 
 }
+
+type imgChmodArgs struct {
+	Target    string
+	Mode      uint16
+	ModeSet   bool
+	Owner     string
+	OwnerSet  bool
+	Group     string
+	GroupSet  bool
+	Recursive bool
+}
+
+type imgChmodRet struct {
+	Ok    bool
+	Quota bool
+}
+
+func (i *Images) chmod(s *Session, w http.ResponseWriter, r *http.Request) {
+	args := new(imgChmodArgs)
+	args.Target = strings.TrimPrefix(r.URL.Path, i.s.servicesVersionString())
+	args.Recursive = r.URL.Query().Get("recursive") == "true"
+	if val := r.URL.Query().Get("mode"); val != "" {
+		mode, err := strconv.ParseUint(val, 8, 16)
+		if err != nil || mode > 0777 {
+			w.Write(NewFailResponse(0, "bad mode").JSON())
+			return
+		}
+		args.Mode = uint16(mode)
+		args.ModeSet = true
+	}
+	if val := r.URL.Query().Get("owner"); val != "" {
+		args.Owner = val
+		args.OwnerSet = true
+	}
+	if val := r.URL.Query().Get("group"); val != "" {
+		args.Group = val
+		args.GroupSet = true
+	}
+
+	nodes, err := i.s.data.subtree(splitPath(args.Target))
+	if err != nil || len(nodes) == 0 {
+		w.Write(NewFailResponse(0, "no such file").JSON())
+		return
+	}
+	if !args.Recursive {
+		nodes = nodes[:1]
+	}
+	for _, node := range nodes {
+		if !s.CanChmod(&node.Rules, args) {
+			w.Write(ResponseAccessDenied.JSON())
+			return
+		}
+	}
+
+	ret := i.s.sync("imagesChmod", args)
+	x, ok := ret.(*imgChmodRet)
+	if ok && x.Quota {
+		w.Write(ResponseQuotaExceeded.JSON())
+		return
+	}
+	if !ok || !x.Ok {
+		w.Write(NewFailResponse(0, "").JSON())
+		return
+	}
+	w.Write(NewSuccessResponse(nil).JSON())
+}
+
+func (i *Images) chmodFSM(data []byte) interface{} {
+	ret := new(imgChmodRet)
+	args := new(imgChmodArgs)
+	err := decode(data, args)
+	if err != nil {
+		return ret
+	}
+	err = i.s.data.imagesChmod(args)
+	ret.Ok = err == nil
+	ret.Quota = err == errQuotaExceeded
+	return ret
+}
+
+type imgMoveArgs struct {
+	Source string
+	Dest   string
+	Copy   bool
+	Owner  string
+	Group  string
+}
+
+type imgMoveRet struct {
+	Ok    bool
+	Quota bool
+}
+
+// checkMove validates the destination of a move or copy request and checks
+// the permissions the session needs on both ends of it.
+func (i *Images) checkMove(s *Session, w http.ResponseWriter, r *http.Request, dest string) (string, string, bool) {
+	source := strings.TrimPrefix(r.URL.Path, i.s.servicesVersionString())
+	source = strings.TrimSuffix(source, "/")
+	dest = "/" + strings.Trim(dest, "/")
+	if !strings.HasPrefix(dest, "/images/") || source == dest || strings.HasPrefix(dest, source+"/") {
+		w.Write(NewFailResponse(0, "bad destination").JSON())
+		return "", "", false
+	}
+	parent, _ := splitPath(dest)
+	if !i.s.CanWriteFile(s, parent) || !i.s.CanExecFile(s, parent) {
+		w.Write(ResponseAccessDenied.JSON())
+		return "", "", false
+	}
+	path, name := splitPath(source)
+	if i.s.data.hasChildren(path, name) && r.URL.Query().Get("recursive") != "true" {
+		w.Write(NewFailResponse(0, "can't move or copy without recursion").JSON())
+		return "", "", false
+	}
+	return source, dest, true
+}
+
+func (i *Images) move(s *Session, w http.ResponseWriter, r *http.Request) {
+	source, dest, ok := i.checkMove(s, w, r, r.URL.Query().Get("move"))
+	if !ok {
+		return
+	}
+	if r.URL.Query().Get("recursive") == "true" && !i.s.CanRecursiveFile(s, source) {
+		w.Write(ResponseAccessDenied.JSON())
+		return
+	}
+	i.syncMove(w, &imgMoveArgs{Source: source, Dest: dest})
+}
+
+func (i *Images) copy(s *Session, w http.ResponseWriter, r *http.Request) {
+	source, dest, ok := i.checkMove(s, w, r, r.URL.Query().Get("copy"))
+	if !ok {
+		return
+	}
+	if !i.s.CanRecursiveReadFile(s, source) {
+		w.Write(ResponseAccessDenied.JSON())
+		return
+	}
+	i.syncMove(w, &imgMoveArgs{
+		Source: source,
+		Dest:   dest,
+		Copy:   true,
+		Owner:  s.User.Name(),
+		Group:  s.User.PrimaryGroup(),
+	})
+}
+
+func (i *Images) syncMove(w http.ResponseWriter, args *imgMoveArgs) {
+	ret := i.s.sync("imagesMove", args)
+	x, ok := ret.(*imgMoveRet)
+	if ok && x.Quota {
+		w.Write(ResponseQuotaExceeded.JSON())
+		return
+	}
+	if !ok || !x.Ok {
+		w.Write(NewFailResponse(0, "").JSON())
+		return
+	}
+	if args.Copy {
+		i.warnQuotas(args.Owner, args.Group)
+	}
+	w.Write(NewSuccessResponse(nil).JSON())
+}
+
+func (i *Images) moveFSM(data []byte) interface{} {
+	ret := new(imgMoveRet)
+	args := new(imgMoveArgs)
+	err := decode(data, args)
+	if err != nil {
+		return ret
+	}
+	if args.Copy {
+		err = i.s.data.imagesCopy(args)
+		ret.Ok = err == nil
+		ret.Quota = err == errQuotaExceeded
+	} else {
+		ret.Ok = i.s.data.imagesMove(args)
+	}
+	return ret
+}
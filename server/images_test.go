@@ -0,0 +1,36 @@
+package server
+
+import (
+	"testing"
+)
+
+func TestCopyFromReadOnlyFolder(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+	alice, carol := permClasses[0].sess, permClasses[2].sess
+	testInsert(t, s, "folder", "/images", "src", &Rules{Owner: "alice", Group: "dev", Mode: 0755})
+	testInsert(t, s, "file", "/images/src", "f", &Rules{Owner: "alice", Group: "dev", Mode: 0644})
+	testInsert(t, s, "folder", "/images", "dst", &Rules{Owner: "carol", Group: "carol", Mode: 0755})
+
+	testServe(t, s, carol, "POST", "/images/src/f?move=/images/dst/f", s.images.move)
+	if _, err := s.data.getRules("/images/dst", "f"); err == nil {
+		t.Fatal("moved out of a folder without write permission")
+	}
+
+	testServe(t, s, carol, "POST", "/images/src/f?copy=/images/dst/f", s.images.copy)
+	r, err := s.data.getRules("/images/dst", "f")
+	if err != nil {
+		t.Fatalf("copy from a read-only folder failed: %v", err)
+	}
+	if r.Owner != "carol" {
+		t.Fatalf("copy owned by %s", r.Owner)
+	}
+	if _, err = s.data.getRules("/images/src", "f"); err != nil {
+		t.Fatal("copy removed the source")
+	}
+
+	testServe(t, s, alice, "POST", "/images/dst/f?copy=/images/src/g", s.images.copy)
+	if _, err = s.data.getRules("/images/src", "g"); err != nil {
+		t.Fatalf("owner couldn't copy back into their folder: %v", err)
+	}
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	maxLabelKey = 128
+	maxLabelVal = 255
+	maxTagName  = 128
+)
+
+var (
+	ResponseNoSuchTag = NewFailResponse(0, "no such tag")
+
+	errBadLabel = errors.New("bad label")
+	errBadTag   = errors.New("bad tag")
+)
+
+// parseLabels reads the label and tag changes requested in the Label, Tag
+// and Untag headers. Labels are written as "key=value", with an empty value
+// removing the label. Tags are written as "name" to point at the image's
+// current contents or "name=revision" to point at an old revision.
+func parseLabels(h http.Header, ul *uploadData) error {
+	for _, val := range h["Label"] {
+		x := strings.SplitN(val, "=", 2)
+		if len(x) != 2 || x[0] == "" || len(x[0]) > maxLabelKey || len(x[1]) > maxLabelVal {
+			return errBadLabel
+		}
+		if ul.Labels == nil {
+			ul.Labels = make(map[string]string)
+		}
+		ul.Labels[strings.TrimSpace(x[0])] = strings.TrimSpace(x[1])
+	}
+
+	for _, val := range h["Tag"] {
+		x := strings.SplitN(val, "=", 2)
+		name := strings.TrimSpace(x[0])
+		if !validTag(name) {
+			return errBadTag
+		}
+		rev := 0
+		if len(x) == 2 {
+			var err error
+			rev, err = strconv.Atoi(strings.TrimSpace(x[1]))
+			if err != nil || rev < 0 {
+				return errBadTag
+			}
+		}
+		if ul.Tags == nil {
+			ul.Tags = make(map[string]int)
+		}
+		ul.Tags[name] = rev
+	}
+
+	for _, val := range h["Untag"] {
+		name := strings.TrimSpace(val)
+		if !validTag(name) {
+			return errBadTag
+		}
+		ul.Untags = append(ul.Untags, name)
+	}
+
+	return nil
+}
+
+func validTag(name string) bool {
+	return name != "" && len(name) <= maxTagName && !strings.ContainsAny(name, "=/")
+}
+
+// canMoveTags checks that the session may write to every image the tags in
+// ul currently point at in its folder, since setting a tag takes it away
+// from them.
+func (i *Images) canMoveTags(s *Session, ul *uploadData) bool {
+	path, _ := splitPath(ul.Target)
+	for tag := range ul.Tags {
+		pl, err := i.s.data.tagsResolve(tag, path)
+		if err != nil {
+			continue
+		}
+		if pl.Path != ul.Target && !i.s.CanWriteFile(s, pl.Path) {
+			return false
+		}
+	}
+	return true
+}
+
+// findLabels lists the images beneath the requested folder that carry every
+// label given as "key=value" in the label query, leaving out any the session
+// can't read.
+func (i *Images) findLabels(s *Session, w http.ResponseWriter, r *http.Request) {
+	labels := make(map[string]string)
+	for _, val := range r.URL.Query()["label"] {
+		x := strings.SplitN(val, "=", 2)
+		if len(x) != 2 || x[0] == "" {
+			w.Write(NewFailResponse(0, errBadLabel.Error()).JSON())
+			return
+		}
+		labels[x[0]] = x[1]
+	}
+
+	path, name := splitPath(strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, i.s.servicesVersionString()), "/"))
+	paths, err := i.s.data.labelsFind(path, name, labels)
+	if err != nil {
+		panic(err)
+	}
+	matches := []string{}
+	for _, p := range paths {
+		if i.s.CanReadFile(s, p) {
+			matches = append(matches, p)
+		}
+	}
+	w.Write(NewSuccessResponse(matches).JSON())
+}
+
+// resolveTag looks up the image a tag points at, starting in the requested
+// folder and walking up towards the root until a folder setting the tag is
+// found. The image is downloaded directly if the download query is true.
+func (i *Images) resolveTag(s *Session, w http.ResponseWriter, r *http.Request) {
+	folder := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, i.s.servicesVersionString()), "/")
+	folders := []string{folder}
+	for folder != "" {
+		folder, _ = splitPath(folder)
+		folders = append(folders, folder)
+	}
+	pl, err := i.s.data.tagsResolve(r.URL.Query().Get("tag"), folders...)
+	if err != nil {
+		w.Write(ResponseNoSuchTag.JSON())
+		return
+	}
+	if !i.s.CanReadFile(s, pl.Path) {
+		w.Write(ResponseAccessDenied.JSON())
+		return
+	}
+	if r.URL.Query().Get("download") != "true" {
+		w.Write(NewSuccessResponse(pl).JSON())
+		return
+	}
+	i.deliver(w, r, pl.Path, pl.Checksum, pl.Date)
+}
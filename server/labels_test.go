@@ -0,0 +1,53 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTagsScopedToFolders(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+	open := &Rules{Owner: "alice", Group: "dev", Mode: 0777}
+	testInsert(t, s, "folder", "/images", "a", open)
+	testInsert(t, s, "folder", "/images/a", "sub", open)
+	testInsert(t, s, "folder", "/images", "b", open)
+	for _, target := range []string{"/images/a/x", "/images/b/y"} {
+		path, name := splitPath(target)
+		testInsert(t, s, "file", path, name, &Rules{Owner: "alice", Group: "dev", Mode: 0644})
+		_, err := s.data.db.Exec("INSERT INTO images(id, time, auth, desc, chk) SELECT id, 0, '', '', ? FROM files WHERE path=? AND name=?", sha256Hex(target), path, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !s.data.imagesAttr(&uploadData{Target: target, Tags: map[string]int{"latest": 0}}) {
+			t.Fatalf("tagging %s failed", target)
+		}
+	}
+
+	alice := permClasses[0].sess
+	for folder, want := range map[string]string{
+		"/images/a/sub": "/images/a/x",
+		"/images/a":     "/images/a/x",
+		"/images/b":     "/images/b/y",
+	} {
+		w := testServe(t, s, alice, "GET", folder+"?tag=latest", s.images.resolveTag)
+		if !strings.Contains(w.Body.String(), `"path":"`+want+`"`) {
+			t.Fatalf("tag resolved from %s: %s", folder, w.Body.String())
+		}
+	}
+	w := testServe(t, s, alice, "GET", "/images?tag=latest", s.images.resolveTag)
+	if strings.Contains(w.Body.String(), `"path"`) {
+		t.Fatalf("tag resolved above the folders setting it: %s", w.Body.String())
+	}
+
+	if !s.data.imagesMove(&imgMoveArgs{Source: "/images/b/y", Dest: "/images/a/y"}) {
+		t.Fatal("move failed")
+	}
+	pl, err := s.data.tagsResolve("latest", "/images/a")
+	if err != nil || pl.Path != "/images/a/x" {
+		t.Fatalf("moved image took the tag of its new folder: %v %v", pl, err)
+	}
+	if _, err = s.data.tagsResolve("latest", "/images/b"); err == nil {
+		t.Fatal("tag left behind in the old folder")
+	}
+}
@@ -152,6 +152,27 @@ func (m *Messages) postLog(log *Log) error {
 	return nil
 }
 
+// serverLog records a message on behalf of the server itself. Only root can
+// read it.
+func (m *Messages) serverLog(severity Severity, code, message string, args map[string]string) {
+	log := &Log{
+		Severity: severity,
+		Time:     time.Now().Unix(),
+		Rules: Rules{
+			Owner: "root",
+			Group: "root",
+			Mode:  0700,
+		},
+		Code:    code,
+		Message: message,
+		Args:    args,
+	}
+	ret := m.s.sync("message", log)
+	if err, ok := ret.(error); ok && err != nil {
+		m.log.Error("failed to record server message", "code", code, "error", err)
+	}
+}
+
 func (m *Messages) httpDebug(s *Session, w http.ResponseWriter, r *http.Request) {
 	m.http(s, w, r, Debug)
 }
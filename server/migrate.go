@@ -0,0 +1,451 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	settingStorage   = "storage"
+	migrateReportPct = 10
+	migrateCatchUp   = 5 * time.Second
+)
+
+var (
+	ResponseMigrationRunning = NewFailResponse(0, "a storage migration is already running")
+	ResponseNoBackend        = NewFailResponse(0, "no such storage backend")
+	ResponseNotShared        = NewFailResponse(0, "replicated blobs can only be migrated to shared storage")
+
+	errMigrateChecksum = errors.New("checksum mismatch")
+)
+
+/*
+migration copies every stored blob from the active storage backend to one of
+the backends named in the storage configuration and then switches the whole
+cluster over to it. Only the backend's name is replicated and recorded, so
+credentials stay in each node's configuration file. The checksums already
+copied are recorded in a state file beneath the data base, so an interrupted
+migration resumes where it left off when the server next starts, or when the
+same migration is requested again.
+
+With local or sharded storage and replication, blobs this node doesn't hold
+are fetched from the peers that do. Every node then switches to the one
+destination, so it has to be storage the whole cluster shares.
+*/
+type migration struct {
+	lock    sync.Mutex
+	running bool
+	status  migrationPL
+}
+
+type migrationPL struct {
+	Running bool   `json:"running"`
+	Total   int    `json:"total"`
+	Copied  int    `json:"copied"`
+	Failed  int    `json:"failed"`
+	Flipped bool   `json:"flipped"`
+	Error   string `json:"error,omitempty"`
+}
+
+type migrationState struct {
+	Backend string          `json:"backend"`
+	Done    map[string]bool `json:"done"`
+}
+
+type flipArgs struct {
+	Backend string
+}
+
+// backend is the storage blobs are currently kept in, which a migration can
+// switch while requests are using it.
+type backend struct {
+	lock  sync.RWMutex
+	store storage
+	mode  string
+}
+
+// storage returns the active storage backend.
+func (i *Images) storage() storage {
+	i.active.lock.RLock()
+	defer i.active.lock.RUnlock()
+	return i.active.store
+}
+
+// storageMode returns the mode of the active storage backend.
+func (i *Images) storageMode() string {
+	i.active.lock.RLock()
+	defer i.active.lock.RUnlock()
+	return i.active.mode
+}
+
+// migratedStorage is the storage a migration switched to, reading through to
+// the storage it switched from for blobs that haven't been copied over yet.
+type migratedStorage struct {
+	storage
+	prev storage
+}
+
+func (m *migratedStorage) Get(name string) (blob, error) {
+	b, err := m.storage.Get(name)
+	if os.IsNotExist(err) {
+		return m.prev.Get(name)
+	}
+	return b, err
+}
+
+func (m *migratedStorage) Stat(name string) (int64, error) {
+	size, err := m.storage.Stat(name)
+	if os.IsNotExist(err) {
+		return m.prev.Stat(name)
+	}
+	return size, err
+}
+
+func (i *Images) setStorage(store storage, mode string) {
+	i.active.lock.Lock()
+	i.active.store = store
+	i.active.mode = mode
+	i.active.lock.Unlock()
+}
+
+func (i *Images) migrationStatePath() string {
+	return i.s.conf.Base + "/migrate.json"
+}
+
+// loadActiveStorage sets up the storage backend the cluster last migrated
+// to, or the one in the config file if it has never migrated.
+func (i *Images) loadActiveStorage() error {
+	name, err := i.s.data.getSetting(settingStorage)
+	if err != nil {
+		return err
+	}
+	config := &i.s.conf.Storage
+	if name != "" {
+		config, err = config.backend(name)
+		if err != nil {
+			return err
+		}
+	}
+	store, err := initStorage(config)
+	if err != nil {
+		return err
+	}
+	i.setStorage(store, config.Type)
+	return nil
+}
+
+// flipFSM switches the node to the storage backend a migration copied every
+// blob to, and records it so the switch survives restarts.
+func (i *Images) flipFSM(data []byte) interface{} {
+	args := new(flipArgs)
+	ret := new(blobRet)
+	err := decode(data, args)
+	if err != nil {
+		return ret
+	}
+	config, err := i.s.conf.Storage.backend(args.Backend)
+	if err != nil {
+		i.log.Error("couldn't switch to migrated storage", "error", err)
+		return ret
+	}
+	store, err := initStorage(config)
+	if err != nil {
+		i.log.Error("couldn't switch to migrated storage", "error", err)
+		return ret
+	}
+	if !i.s.data.setSetting(settingStorage, args.Backend) {
+		return ret
+	}
+	// uploads that started before the switch may still be putting blobs in
+	// the old storage, so keep reading from it until restarted
+	i.setStorage(&migratedStorage{store, i.storage()}, config.Type)
+	ret.Ok = true
+	return ret
+}
+
+// migrate starts migrating to the storage backend named in the to query.
+func (i *Images) migrate(s *Session, w http.ResponseWriter, r *http.Request) {
+	if !i.s.CanWriteFile(s, "/storage/migrate") {
+		w.Write(ResponseAccessDenied.JSON())
+		return
+	}
+	name := r.URL.Query().Get("to")
+	config, err := i.s.conf.Storage.backend(name)
+	if err != nil {
+		w.Write(ResponseNoBackend.JSON())
+		return
+	}
+	if i.replicating() && !sharedStorage(config.Type) {
+		w.Write(ResponseNotShared.JSON())
+		return
+	}
+	dest, err := initStorage(config)
+	if err != nil {
+		w.Write(NewFailResponse(0, err.Error()).JSON())
+		return
+	}
+
+	state := i.loadMigrationState()
+	if state == nil || state.Backend != name {
+		state = &migrationState{name, make(map[string]bool)}
+	}
+	if !i.startMigration(dest, state) {
+		w.Write(ResponseMigrationRunning.JSON())
+		return
+	}
+	w.Write(NewSuccessResponse(nil).JSON())
+}
+
+func (i *Images) migrateStatus(s *Session, w http.ResponseWriter, r *http.Request) {
+	i.migr.lock.Lock()
+	pl := i.migr.status
+	i.migr.lock.Unlock()
+	w.Write(NewSuccessResponse(&pl).JSON())
+}
+
+// resumeMigration restarts a migration that was interrupted by the server
+// stopping.
+func (i *Images) resumeMigration() {
+	state := i.loadMigrationState()
+	if state == nil {
+		return
+	}
+	config, err := i.s.conf.Storage.backend(state.Backend)
+	if err != nil {
+		i.log.Error("couldn't resume storage migration", "error", err)
+		return
+	}
+	dest, err := initStorage(config)
+	if err != nil {
+		i.log.Error("couldn't resume storage migration", "error", err)
+		return
+	}
+	i.startMigration(dest, state)
+}
+
+// sharedStorage reports whether every node sees the same blobs in storage of
+// the given mode.
+func sharedStorage(mode string) bool {
+	return mode != "local" && mode != "sharded" && mode != "memory"
+}
+
+func (i *Images) loadMigrationState() *migrationState {
+	data, err := ioutil.ReadFile(i.migrationStatePath())
+	if err != nil {
+		return nil
+	}
+	state := new(migrationState)
+	err = json.Unmarshal(data, state)
+	if err != nil {
+		i.log.Error("ignoring corrupt storage migration state", "error", err)
+		return nil
+	}
+	if state.Done == nil {
+		state.Done = make(map[string]bool)
+	}
+	return state
+}
+
+func (i *Images) saveMigrationState(state *migrationState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmp := i.migrationStatePath() + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, i.migrationStatePath())
+}
+
+func (i *Images) startMigration(dest storage, state *migrationState) bool {
+	i.migr.lock.Lock()
+	defer i.migr.lock.Unlock()
+	if i.migr.running {
+		return false
+	}
+	i.migr.running = true
+	i.migr.status = migrationPL{Running: true}
+	go i.runMigration(dest, state)
+	return true
+}
+
+func (i *Images) setMigrationStatus(fn func(pl *migrationPL)) {
+	i.migr.lock.Lock()
+	fn(&i.migr.status)
+	i.migr.lock.Unlock()
+}
+
+func (i *Images) runMigration(dest storage, state *migrationState) {
+	defer func() {
+		if r := recover(); r != nil {
+			i.log.Error("storage migration failed", "error", r)
+		}
+		i.setMigrationStatus(func(pl *migrationPL) {
+			pl.Running = false
+		})
+		i.migr.lock.Lock()
+		i.migr.running = false
+		i.migr.lock.Unlock()
+	}()
+
+	i.s.journal.serverLog(Info, "STORAGE_MIGRATION_STARTED", "storage migration started", map[string]string{"backend": state.Backend})
+
+	src := i.storage()
+	fetch := i.replicating()
+	_, failed := i.migrationPass(src, dest, state, fetch)
+	if failed > 0 {
+		msg := strconv.Itoa(failed) + " blobs couldn't be copied"
+		i.setMigrationStatus(func(pl *migrationPL) {
+			pl.Error = msg
+		})
+		i.s.journal.serverLog(Error, "STORAGE_MIGRATION_FAILED", "storage migration incomplete", map[string]string{"failed": strconv.Itoa(failed)})
+		return
+	}
+
+	ret := i.s.sync("storageFlip", &flipArgs{state.Backend})
+	if x, ok := ret.(*blobRet); !ok || !x.Ok {
+		i.setMigrationStatus(func(pl *migrationPL) {
+			pl.Error = "couldn't switch storage"
+		})
+		i.s.journal.serverLog(Error, "STORAGE_MIGRATION_FAILED", "couldn't switch to migrated storage", nil)
+		return
+	}
+	i.setMigrationStatus(func(pl *migrationPL) {
+		pl.Flipped = true
+	})
+
+	// catch up with anything uploaded to the old storage while the first
+	// pass was running. Uploads that reserved their blobs before the switch
+	// may not have put them anywhere yet, so keep going until those have
+	// settled and a pass finds nothing more to copy.
+	inflight := i.reservedBlobs(nil)
+	for {
+		copied, failed := i.migrationPass(src, dest, state, fetch)
+		if failed > 0 {
+			i.s.journal.serverLog(Error, "STORAGE_MIGRATION_FAILED", "blobs uploaded during migration couldn't be copied", map[string]string{"failed": strconv.Itoa(failed)})
+			return
+		}
+		inflight = i.reservedBlobs(inflight)
+		if copied == 0 && len(inflight) == 0 {
+			break
+		}
+		time.Sleep(migrateCatchUp)
+	}
+
+	os.Remove(i.migrationStatePath())
+	i.s.journal.serverLog(Info, "STORAGE_MIGRATION_COMPLETE", "storage migration complete", map[string]string{"backend": state.Backend})
+}
+
+// reservedBlobs returns the blobs reserved by uploads that haven't stored
+// them yet. If among isn't nil, only blobs in it are returned.
+func (i *Images) reservedBlobs(among map[string]bool) map[string]bool {
+	blobs, err := i.s.data.blobsList()
+	if err != nil {
+		panic(err)
+	}
+	reserved := make(map[string]bool)
+	for chk, blob := range blobs {
+		if !blob.Stored && !blob.Dead && (among == nil || among[chk]) {
+			reserved[chk] = true
+		}
+	}
+	return reserved
+}
+
+// migrationPass copies every stored blob not yet recorded as done from src
+// to dest, returning the number copied and the number that couldn't be. If
+// fetch is set, blobs missing from src are fetched from the peers holding
+// them.
+func (i *Images) migrationPass(src, dest storage, state *migrationState, fetch bool) (int, int) {
+	blobs, err := i.s.data.blobsList()
+	if err != nil {
+		panic(err)
+	}
+
+	var todo []string
+	for chk, blob := range blobs {
+		if blob.Stored && !blob.Dead && !state.Done[chk] {
+			todo = append(todo, chk)
+		}
+	}
+	i.setMigrationStatus(func(pl *migrationPL) {
+		pl.Total = len(state.Done) + len(todo)
+		pl.Copied = len(state.Done)
+		pl.Failed = 0
+	})
+
+	var holders map[string][]string
+	if fetch && len(todo) > 0 {
+		_, holders, err = i.s.data.replicationState()
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	copied := 0
+	failed := 0
+	reported := 0
+	for n, chk := range todo {
+		err = i.migrateBlob(src, dest, chk, holders[chk])
+		if err != nil {
+			failed++
+			i.log.Error("couldn't migrate blob", "checksum", chk, "error", err)
+		} else {
+			copied++
+			state.Done[chk] = true
+			err = i.saveMigrationState(state)
+			if err != nil {
+				panic(err)
+			}
+		}
+		i.setMigrationStatus(func(pl *migrationPL) {
+			pl.Copied = len(state.Done)
+			pl.Failed = failed
+		})
+		pct := (n + 1) * 100 / len(todo)
+		if pct >= reported+migrateReportPct {
+			reported = pct - pct%migrateReportPct
+			i.s.journal.serverLog(Info, "STORAGE_MIGRATION_PROGRESS", "storage migration progress", map[string]string{
+				"percent": strconv.Itoa(reported),
+				"copied":  strconv.Itoa(len(state.Done)),
+				"failed":  strconv.Itoa(failed),
+			})
+		}
+	}
+	return copied, failed
+}
+
+// migrateBlob copies a single blob, verifying its checksum on the way. A
+// blob src doesn't have is fetched from peers, or if there are none, is
+// expected to be in dest already, put there by an upload after the switch.
+func (i *Images) migrateBlob(src, dest storage, chk string, peers []string) error {
+	file, err := src.Get(chk)
+	if os.IsNotExist(err) {
+		if len(peers) > 0 {
+			return i.fetchInto(dest, chk, peers)
+		}
+		_, err = dest.Stat(chk)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	tmp, sums, err := i.stage(file)
+	file.Close()
+	if err != nil {
+		return err
+	}
+	if sums.checksum() != chk {
+		os.Remove(tmp)
+		return errMigrateChecksum
+	}
+	return dest.Put(chk, tmp)
+}
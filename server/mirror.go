@@ -0,0 +1,567 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+A folder can mirror an upstream, either a folder on another vorteil cluster or
+a plain HTTP directory listing. Reads of images missing beneath a mirrored
+folder are fetched from the upstream, checked and cached as ordinary images
+owned by whoever set up the mirror. A mirror with an interval is also synced
+on a schedule, copying across every image it doesn't have and, for vorteil
+upstreams, any whose checksum has changed. Images removed upstream are kept.
+Credentials for upstreams that need them, such as vorteil clusters, are
+configured on each node under mirrors and sent with HTTP basic auth.
+*/
+
+const (
+	mirrorVorteil = "vorteil"
+	mirrorHTTP    = "http"
+
+	mirrorTick       = time.Minute
+	mirrorListLength = 1000
+)
+
+var (
+	ResponseBadMirror = NewFailResponse(0, "bad mirror")
+	ResponseNoMirror  = NewFailResponse(0, "no mirror")
+
+	ResponseMirrorNotAllowed = NewFailResponse(0, "upstream not allowed")
+
+	errMirrorMissing = errors.New("not found upstream")
+	errMirrorListing = errors.New("bad upstream listing")
+	errMirrorAllowed = errors.New("upstream not allowed")
+
+	hrefRegexp = regexp.MustCompile(`(?i)<a\s[^>]*href\s*=\s*"([^"]*)"`)
+)
+
+// mirrorConfiguration lists the upstreams folders may mirror, with any
+// credentials to present to them. Mirrors of anything else are refused, so
+// the cluster can't be pointed at internal addresses. Credentials stay in
+// each node's config rather than being replicated with the mirrors.
+type mirrorConfiguration struct {
+	Upstreams []mirrorUpstream `yaml:"upstreams"`
+}
+
+// mirrorUpstream applies to every mirror whose URL is URL or lies beneath
+// it.
+type mirrorUpstream struct {
+	URL      string `yaml:"url"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+func (u *mirrorUpstream) covers(raw string) bool {
+	prefix := strings.TrimSuffix(u.URL, "/")
+	return prefix != "" && (raw == prefix || strings.HasPrefix(raw, prefix+"/"))
+}
+
+type mirrorer struct {
+	lock    sync.Mutex
+	running map[string]bool
+	client  *http.Client
+}
+
+type mirror struct {
+	Path     string `json:"path"`
+	URL      string `json:"url"`
+	Kind     string `json:"kind"`
+	Interval int64  `json:"interval,omitempty"`
+	Owner    string `json:"owner"`
+	Group    string `json:"group"`
+	Mode     uint16 `json:"mode"`
+	Last     int64  `json:"last,omitempty"`
+}
+
+type mirrorArgs struct {
+	Mirror mirror
+	Remove bool
+	Now    int64
+}
+
+type mirrorRet struct {
+	Ok bool
+}
+
+// remoteEntry is a file listed by an upstream. Checksum is only known for
+// vorteil upstreams.
+type remoteEntry struct {
+	Name     string
+	Folder   bool
+	Checksum string
+}
+
+func (i *Images) setupMirrors() {
+	i.mirr.running = make(map[string]bool)
+	i.mirr.client = &http.Client{}
+}
+
+func (i *Images) startMirrors() {
+	go i.mirrorLoop()
+}
+
+func (i *Images) mirrorSetFSM(data []byte) interface{} {
+	args := new(mirrorArgs)
+	ret := new(mirrorRet)
+	err := decode(data, args)
+	if err != nil {
+		return ret
+	}
+	if args.Remove {
+		ret.Ok = i.s.data.mirrorRemove(args.Mirror.Path)
+	} else {
+		ret.Ok = i.s.data.mirrorSet(&args.Mirror)
+	}
+	return ret
+}
+
+func (i *Images) mirrorSyncedFSM(data []byte) interface{} {
+	args := new(mirrorArgs)
+	ret := new(mirrorRet)
+	err := decode(data, args)
+	if err != nil {
+		return ret
+	}
+	ret.Ok = i.s.data.mirrorSynced(args.Mirror.Path, args.Mirror.Last)
+	return ret
+}
+
+func (i *Images) mirrorClaimFSM(data []byte) interface{} {
+	args := new(mirrorArgs)
+	ret := new(mirrorRet)
+	err := decode(data, args)
+	if err != nil {
+		return ret
+	}
+	ret.Ok = i.s.data.mirrorClaim(args.Mirror.Path, args.Mirror.Last, args.Now)
+	return ret
+}
+
+// setMirror makes a folder mirror the upstream URL, which must lie beneath
+// one of the configured upstreams. Only the folder's owner may do so. The
+// kind of upstream is "http" unless given, and a positive interval in
+// seconds turns on scheduled syncing.
+func (i *Images) setMirror(s *Session, w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	m := &mirror{
+		Path:  i.target(r),
+		URL:   strings.TrimSuffix(q.Get("mirror"), "/"),
+		Kind:  q.Get("kind"),
+		Owner: s.User.Name(),
+		Group: s.User.PrimaryGroup(),
+		Mode:  s.Mode(),
+	}
+	if m.Kind == "" {
+		m.Kind = mirrorHTTP
+	}
+	u, err := url.Parse(m.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || (m.Kind != mirrorHTTP && m.Kind != mirrorVorteil) {
+		w.Write(ResponseBadMirror.JSON())
+		return
+	}
+	if val := q.Get("interval"); val != "" {
+		m.Interval, err = strconv.ParseInt(val, 10, 64)
+		if err != nil || m.Interval < 0 {
+			w.Write(ResponseBadMirror.JSON())
+			return
+		}
+	}
+	if i.upstreamFor(m.URL) == nil {
+		w.Write(ResponseMirrorNotAllowed.JSON())
+		return
+	}
+	if !strings.HasPrefix(m.Path, "/images/") {
+		w.Write(ResponseAccessDenied.JSON())
+		return
+	}
+	if chk, err := i.s.data.imagesGetInfo(splitPath(m.Path)); err != nil || chk != "folder" {
+		w.Write(ResponseNotFolder.JSON())
+		return
+	}
+	if !i.s.CanOwnFile(s, m.Path) {
+		w.Write(ResponseAccessDenied.JSON())
+		return
+	}
+	i.syncMirrorArgs(w, &mirrorArgs{Mirror: *m})
+}
+
+func (i *Images) removeMirror(s *Session, w http.ResponseWriter, r *http.Request) {
+	target := i.target(r)
+	if !i.s.CanOwnFile(s, target) {
+		w.Write(ResponseAccessDenied.JSON())
+		return
+	}
+	i.syncMirrorArgs(w, &mirrorArgs{Mirror: mirror{Path: target}, Remove: true})
+}
+
+func (i *Images) syncMirrorArgs(w http.ResponseWriter, args *mirrorArgs) {
+	ret := i.s.sync("imagesMirror", args)
+	x, ok := ret.(*mirrorRet)
+	if !ok || !x.Ok {
+		w.Write(NewFailResponse(0, "").JSON())
+		return
+	}
+	w.Write(NewSuccessResponse(nil).JSON())
+}
+
+// getMirror returns the mirror a file falls under.
+func (i *Images) getMirror(s *Session, w http.ResponseWriter, r *http.Request) {
+	m, err := i.s.data.mirrorFor(i.target(r))
+	if err != nil {
+		w.Write(ResponseNoMirror.JSON())
+		return
+	}
+	w.Write(NewSuccessResponse(m).JSON())
+}
+
+// syncNow syncs a mirrored folder straight away rather than waiting for
+// its next scheduled sync.
+func (i *Images) syncNow(s *Session, w http.ResponseWriter, r *http.Request) {
+	target := i.target(r)
+	if !i.s.CanWriteFile(s, target) {
+		w.Write(ResponseAccessDenied.JSON())
+		return
+	}
+	m, err := i.s.data.mirrorFor(target)
+	if err != nil || m.Path != target {
+		w.Write(ResponseNoMirror.JSON())
+		return
+	}
+	err = i.syncMirror(m)
+	if err != nil {
+		w.Write(NewFailResponse(0, err.Error()).JSON())
+		return
+	}
+	w.Write(NewSuccessResponse(nil).JSON())
+}
+
+// pullThrough fetches an image missing from a mirrored folder from its
+// upstream and serves it, reporting false if there is no mirror or the
+// upstream doesn't have it either.
+func (i *Images) pullThrough(w http.ResponseWriter, r *http.Request, target string) bool {
+	m, err := i.s.data.mirrorFor(target)
+	if err != nil {
+		return false
+	}
+	err = i.fetchMirrored(m, target, "imagesUpload")
+	path, name := splitPath(target)
+	// a concurrent read may have cached it first
+	chk, gerr := i.s.data.imagesGetInfo(path, name)
+	if gerr != nil || chk == "folder" {
+		if err != nil && err != errMirrorMissing {
+			i.log.Warn("couldn't fetch mirrored image", "target", target, "upstream", m.URL, "error", err)
+		}
+		return false
+	}
+	_, _, date, _, err := i.s.data.imagesGetAttributes(path, name)
+	if err != nil {
+		panic(err)
+	}
+	i.deliver(w, r, target, chk, date)
+	return true
+}
+
+// upstreamFor returns the configured upstream a mirror URL falls under, or
+// nil if there isn't one.
+func (i *Images) upstreamFor(raw string) *mirrorUpstream {
+	for n := range i.s.conf.Mirrors.Upstreams {
+		if u := &i.s.conf.Mirrors.Upstreams[n]; u.covers(raw) {
+			return u
+		}
+	}
+	return nil
+}
+
+// mirrorGet requests a URL from a mirror's upstream, authenticating with
+// basic auth if credentials are configured for it. Upstreams that have since
+// been removed from the config are no longer contacted.
+func (i *Images) mirrorGet(m *mirror, raw string) (*http.Response, error) {
+	u := i.upstreamFor(m.URL)
+	if u == nil {
+		return nil, errMirrorAllowed
+	}
+	req, err := http.NewRequest("GET", raw, nil)
+	if err != nil {
+		return nil, err
+	}
+	if u.Username != "" {
+		req.SetBasicAuth(u.Username, u.Password)
+	}
+	return i.mirr.client.Do(req)
+}
+
+// upstream returns the URL of the file at target beneath a mirror.
+func (m *mirror) upstream(target string) string {
+	rel := strings.Trim(strings.TrimPrefix(target, m.Path), "/")
+	if rel == "" {
+		return m.URL
+	}
+	elems := strings.Split(rel, "/")
+	for n, elem := range elems {
+		elems[n] = url.PathEscape(elem)
+	}
+	return m.URL + "/" + strings.Join(elems, "/")
+}
+
+// fetchMirrored downloads the upstream copy of target, loads it into
+// storage and commits it using the named FSM function. Downloads from a
+// vorteil upstream are checked against the checksum it serves as the ETag,
+// and any digest headers an HTTP upstream sends are checked too.
+func (i *Images) fetchMirrored(m *mirror, target, fn string) error {
+	resp, err := i.mirrorGet(m, m.upstream(target))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errMirrorMissing
+	}
+
+	h := make(http.Header)
+	if m.Kind == mirrorVorteil {
+		// failures come back as JSON with a 200, and only images carry
+		// their checksum as the ETag
+		chk := strings.Trim(resp.Header.Get("ETag"), "\"")
+		if _, err := parseBlobReference(chk); err != nil {
+			return errMirrorMissing
+		}
+		h.Set("X-Checksum-Sha256", chk)
+	} else {
+		for _, key := range []string{"X-Checksum-Sha256", "Content-MD5", "Digest"} {
+			if val, ok := resp.Header[key]; ok {
+				h[key] = val
+			}
+		}
+	}
+
+	ul := &uploadData{
+		Owner:    m.Owner,
+		Group:    m.Group,
+		Mode:     m.Mode,
+		Target:   target,
+		Parents:  true,
+		KeepLast: i.s.conf.Storage.Revisions.KeepLast,
+		KeepDays: i.s.conf.Storage.Revisions.KeepDays,
+		Now:      time.Now().Unix(),
+	}
+	if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil && t.Unix() > 0 {
+		ul.Time = uint64(t.Unix())
+		ul.TimeSet = true
+	}
+	err = i.load(nil, &http.Request{Header: h, Body: resp.Body}, ul)
+	if err != nil {
+		return err
+	}
+	ul.Reserved = true
+	ul.Node = i.s.conf.Advertise
+	return i.apply(fn, ul)
+}
+
+// listUpstream lists the folder at target beneath a mirror's upstream.
+func (i *Images) listUpstream(m *mirror, target string) ([]remoteEntry, error) {
+	if m.Kind == mirrorVorteil {
+		return i.listVorteil(m, m.upstream(target))
+	}
+	return i.listHTTP(m, m.upstream(target)+"/")
+}
+
+// listVorteil pages through a long listing of a folder on another vorteil
+// cluster.
+func (i *Images) listVorteil(m *mirror, folder string) ([]remoteEntry, error) {
+	var entries []remoteEntry
+	cursor := ""
+	for {
+		q := url.Values{}
+		q.Set("long", "true")
+		q.Set("length", strconv.Itoa(mirrorListLength))
+		if cursor != "" {
+			q.Set("cursor", cursor)
+		}
+		resp, err := i.mirrorGet(m, folder+"?"+q.Encode())
+		if err != nil {
+			return nil, err
+		}
+		// folderPL can't be decoded into, as it embeds an unexported
+		// pointer
+		var wrapper struct {
+			Code    int `json:"status_code"`
+			Payload *struct {
+				List []struct {
+					Name     string `json:"name"`
+					Type     string `json:"type"`
+					Checksum string `json:"checksum"`
+				} `json:"list"`
+				Next string `json:"next"`
+			} `json:"payload"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&wrapper)
+		resp.Body.Close()
+		if err != nil || wrapper.Code != http.StatusOK || wrapper.Payload == nil {
+			return nil, errMirrorListing
+		}
+		for _, child := range wrapper.Payload.List {
+			entries = append(entries, remoteEntry{child.Name, child.Type == "folder", child.Checksum})
+		}
+		cursor = wrapper.Payload.Next
+		if cursor == "" {
+			return entries, nil
+		}
+	}
+}
+
+// listHTTP scrapes the links out of an HTTP directory listing. Links to
+// anything other than a direct child are ignored, and those ending in a
+// slash are taken to be folders.
+func (i *Images) listHTTP(m *mirror, folder string) ([]remoteEntry, error) {
+	resp, err := i.mirrorGet(m, folder)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errMirrorListing
+	}
+	page, err := ioutil.ReadAll(io.LimitReader(resp.Body, 16<<20))
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []remoteEntry
+	seen := make(map[string]bool)
+	for _, match := range hrefRegexp.FindAllStringSubmatch(string(page), -1) {
+		href := strings.TrimPrefix(match[1], "./")
+		if href == "" || strings.ContainsAny(href, "?#:") || strings.HasPrefix(href, "/") || strings.HasPrefix(href, "..") {
+			continue
+		}
+		folder := strings.HasSuffix(href, "/")
+		name, err := url.PathUnescape(strings.TrimSuffix(href, "/"))
+		if err != nil || name == "" || strings.Contains(name, "/") || seen[name] {
+			continue
+		}
+		seen[name] = true
+		entries = append(entries, remoteEntry{Name: name, Folder: folder})
+	}
+	return entries, nil
+}
+
+// syncMirror copies across every image beneath a mirror that is missing
+// locally, or that a vorteil upstream reports has different contents. Only
+// one sync of a mirror runs on a node at a time.
+func (i *Images) syncMirror(m *mirror) error {
+	i.mirr.lock.Lock()
+	if i.mirr.running[m.Path] {
+		i.mirr.lock.Unlock()
+		return nil
+	}
+	i.mirr.running[m.Path] = true
+	i.mirr.lock.Unlock()
+	defer func() {
+		i.mirr.lock.Lock()
+		delete(i.mirr.running, m.Path)
+		i.mirr.lock.Unlock()
+	}()
+
+	started := time.Now().Unix()
+	err := i.syncMirrorFolder(m, m.Path)
+	if err != nil {
+		return err
+	}
+	ret := i.s.sync("mirrorSynced", &mirrorArgs{Mirror: mirror{Path: m.Path, Last: started}})
+	if x, ok := ret.(*mirrorRet); !ok || !x.Ok {
+		i.log.Error("couldn't record mirror sync", "folder", m.Path)
+	}
+	return nil
+}
+
+func (i *Images) syncMirrorFolder(m *mirror, folder string) error {
+	entries, err := i.listUpstream(m, folder)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		target := folder + "/" + e.Name
+		path, name := splitPath(target)
+		chk, err := i.s.data.imagesGetInfo(path, name)
+		switch {
+		case e.Folder && err != nil:
+			ul := &uploadData{Owner: m.Owner, Group: m.Group, Mode: m.Mode, Target: target, Parents: true}
+			ret := i.s.sync("imagesMkdir", ul)
+			if x, ok := ret.(*uploadRet); !ok || !x.Ok {
+				i.log.Warn("couldn't create mirrored folder", "target", target)
+				continue
+			}
+			fallthrough
+		case e.Folder && chk == "folder":
+			err = i.syncMirrorFolder(m, target)
+		case e.Folder || chk == "folder":
+			i.log.Warn("mirrored file and folder clash", "target", target)
+			continue
+		case err != nil:
+			err = i.fetchMirrored(m, target, "imagesUpload")
+		case e.Checksum != "" && e.Checksum != chk:
+			err = i.fetchMirrored(m, target, "imagesUploadOW")
+		default:
+			continue
+		}
+		if err == errMirrorMissing {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mirrorLoop syncs every mirror whose interval has passed. With several
+// nodes each due mirror is claimed through the raft log, and only the node
+// whose claim is applied first syncs it.
+func (i *Images) mirrorLoop() {
+	ticker := time.NewTicker(mirrorTick)
+	for range ticker.C {
+		i.syncDueMirrors()
+	}
+}
+
+func (i *Images) syncDueMirrors() {
+	defer func() {
+		if r := recover(); r != nil {
+			i.log.Error("mirror sync failed", "error", r)
+		}
+	}()
+
+	mirrors, err := i.s.data.mirrorsList()
+	if err != nil {
+		i.log.Error("couldn't list mirrors", "error", err)
+		return
+	}
+	now := time.Now().Unix()
+	for n := range mirrors {
+		m := &mirrors[n]
+		if m.Interval <= 0 || now-m.Last < m.Interval {
+			continue
+		}
+		// the claim moves the mirror's last sync forward only if no other
+		// node has done so since it was read, so a failed sync waits for
+		// the next interval rather than being retried by every node
+		ret := i.s.sync("mirrorClaim", &mirrorArgs{Mirror: mirror{Path: m.Path, Last: m.Last}, Now: now})
+		if x, ok := ret.(*mirrorRet); !ok || !x.Ok {
+			continue
+		}
+		err = i.syncMirror(m)
+		if err != nil {
+			i.log.Warn("mirror sync failed", "folder", m.Path, "upstream", m.URL, "error", err)
+		}
+	}
+}
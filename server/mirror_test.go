@@ -0,0 +1,223 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testMirror sets up /images/m owned by alice, mirroring url.
+func testMirror(t *testing.T, s *Server, url, kind string, interval int64) *mirror {
+	testInsert(t, s, "folder", "/images", "m", &Rules{Owner: "alice", Group: "alice", Mode: 0755})
+	s.conf.Mirrors.Upstreams = []mirrorUpstream{{URL: url}}
+	m := &mirror{Path: "/images/m", URL: url, Kind: kind, Interval: interval, Owner: "alice", Group: "alice", Mode: 0755}
+	if !s.data.mirrorSet(m) {
+		t.Fatal("couldn't set mirror")
+	}
+	return m
+}
+
+// testDirectory serves a plain HTTP directory holding a.img and sub/b.img.
+func testDirectory(t *testing.T) (*httptest.Server, string) {
+	dir, err := ioutil.TempDir("", "upstream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Mkdir(filepath.Join(dir, "sub"), 0755)
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(dir, "a.img"), []byte("image a"), 0644)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(dir, "sub", "b.img"), []byte("image b"), 0644)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return httptest.NewServer(http.FileServer(http.Dir(dir))), dir
+}
+
+// fakeUpstream imitates a folder of images on another vorteil cluster.
+type fakeUpstream struct {
+	lock  sync.Mutex
+	files map[string]string
+}
+
+func (f *fakeUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	name := strings.TrimPrefix(r.URL.Path, "/images/v")
+	if name == "" || name == "/" {
+		pl := &shortPL{}
+		for n, data := range f.files {
+			pl.List = append(pl.List, folderPL{Name: n, Type: "file", longPL: &longPL{Checksum: sha256Hex(data)}})
+		}
+		pl.Length = len(pl.List)
+		w.Write(NewSuccessResponse(pl).JSON())
+		return
+	}
+	data, ok := f.files[strings.TrimPrefix(name, "/")]
+	if !ok {
+		w.Write(NewFailResponse(0, "no such file").JSON())
+		return
+	}
+	w.Header().Set("ETag", "\""+sha256Hex(data)+"\"")
+	w.Write([]byte(data))
+}
+
+func TestPullThrough(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+	upstream, dir := testDirectory(t)
+	defer os.RemoveAll(dir)
+	defer upstream.Close()
+	testMirror(t, s, upstream.URL, mirrorHTTP, 0)
+
+	alice := testSession("alice", "alice")
+	if s.readTarget("/images/m/a.img") != "/images/m" {
+		t.Fatal("missing mirrored image should be checked against its folder")
+	}
+	w := testGet(s, alice, s.images.read, "/images/m/a.img")
+	if w.Body.String() != "image a" {
+		t.Fatalf("pull-through read returned %q", w.Body.String())
+	}
+	chk, err := s.data.imagesGetInfo("/images/m", "a.img")
+	if err != nil || chk != sha256Hex("image a") {
+		t.Fatalf("pulled image not cached: %q, %v", chk, err)
+	}
+
+	w = testGet(s, alice, s.images.read, "/images/m/missing.img")
+	if !strings.Contains(w.Body.String(), "no such file") {
+		t.Fatalf("image missing upstream returned %q", w.Body.String())
+	}
+}
+
+func TestMirrorUpstreamNotAllowed(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+	upstream, dir := testDirectory(t)
+	defer os.RemoveAll(dir)
+	defer upstream.Close()
+	m := testMirror(t, s, upstream.URL, mirrorHTTP, 0)
+
+	s.conf.Mirrors.Upstreams = []mirrorUpstream{{URL: upstream.URL + "/elsewhere"}}
+	err := s.images.fetchMirrored(m, "/images/m/a.img", "imagesUpload")
+	if err != errMirrorAllowed {
+		t.Fatalf("fetch from unconfigured upstream returned %v", err)
+	}
+}
+
+func TestListHTTP(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+	upstream, dir := testDirectory(t)
+	defer os.RemoveAll(dir)
+	defer upstream.Close()
+	m := testMirror(t, s, upstream.URL, mirrorHTTP, 0)
+
+	entries, err := s.images.listUpstream(m, m.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]bool{"a.img": false, "sub": true}
+	if len(entries) != len(want) {
+		t.Fatalf("listed %v", entries)
+	}
+	for _, e := range entries {
+		folder, ok := want[e.Name]
+		if !ok || folder != e.Folder {
+			t.Fatalf("unexpected entry %+v", e)
+		}
+	}
+}
+
+func TestScheduledSync(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+	upstream, dir := testDirectory(t)
+	defer os.RemoveAll(dir)
+	defer upstream.Close()
+	testMirror(t, s, upstream.URL, mirrorHTTP, 60)
+
+	s.images.syncDueMirrors()
+	for target, data := range map[string]string{"/images/m/a.img": "image a", "/images/m/sub/b.img": "image b"} {
+		path, name := splitPath(target)
+		chk, err := s.data.imagesGetInfo(path, name)
+		if err != nil || chk != sha256Hex(data) {
+			t.Fatalf("%s not synced: %q, %v", target, chk, err)
+		}
+	}
+	m, err := s.data.mirrorFor("/images/m")
+	if err != nil || m.Last == 0 {
+		t.Fatalf("sync not recorded: %+v, %v", m, err)
+	}
+
+	// not due again until the interval has passed
+	err = ioutil.WriteFile(filepath.Join(dir, "c.img"), []byte("image c"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.images.syncDueMirrors()
+	if _, err := s.data.imagesGetInfo("/images/m", "c.img"); err == nil {
+		t.Fatal("mirror synced before its interval passed")
+	}
+}
+
+func TestSyncOverwritesChangedImages(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+	fake := &fakeUpstream{files: map[string]string{"a.img": "version 1"}}
+	upstream := httptest.NewServer(fake)
+	defer upstream.Close()
+	m := testMirror(t, s, upstream.URL+"/images/v", mirrorVorteil, 0)
+
+	err := s.images.syncMirror(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chk, err := s.data.imagesGetInfo("/images/m", "a.img")
+	if err != nil || chk != sha256Hex("version 1") {
+		t.Fatalf("first sync: %q, %v", chk, err)
+	}
+
+	fake.lock.Lock()
+	fake.files["a.img"] = "version 2"
+	fake.lock.Unlock()
+	err = s.images.syncMirror(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chk, err = s.data.imagesGetInfo("/images/m", "a.img")
+	if err != nil || chk != sha256Hex("version 2") {
+		t.Fatalf("changed image not overwritten: %q, %v", chk, err)
+	}
+	revs, err := s.data.imagesRevisions("/images/m", "a.img")
+	if err != nil || len(revs) != 2 || revs[1].Checksum != sha256Hex("version 1") {
+		t.Fatalf("previous contents not kept as a revision: %+v, %v", revs, err)
+	}
+}
+
+func TestMirrorClaimedOnce(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+	m := testMirror(t, s, "http://upstream.example/images", mirrorHTTP, 60)
+
+	// two nodes that both read the mirror as due race to claim it
+	claim := &mirrorArgs{Mirror: mirror{Path: m.Path, Last: m.Last}, Now: 100}
+	first, _ := s.sync("mirrorClaim", claim).(*mirrorRet)
+	second, _ := s.sync("mirrorClaim", claim).(*mirrorRet)
+	if first == nil || !first.Ok {
+		t.Fatal("first claim failed")
+	}
+	if second == nil || second.Ok {
+		t.Fatal("mirror claimed twice")
+	}
+	m, err := s.data.mirrorFor(m.Path)
+	if err != nil || m.Last != 100 {
+		t.Fatalf("claim not recorded: %+v, %v", m, err)
+	}
+}
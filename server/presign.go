@@ -0,0 +1,219 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	settingPresignKey = "presign_key"
+	defaultPresignMax = 7 * 24 * 3600
+)
+
+type presignKeyArgs struct {
+	Key string
+}
+
+type presignPL struct {
+	URL     string `json:"url"`
+	Expires int64  `json:"expires"`
+}
+
+// presignKeyFSM stores the key pre-signed URLs are signed with, unless
+// another node already set one.
+func (i *Images) presignKeyFSM(data []byte) interface{} {
+	args := new(presignKeyArgs)
+	ret := new(signatureRet)
+	err := decode(data, args)
+	if err != nil {
+		return ret
+	}
+	val, err := i.s.data.getSetting(settingPresignKey)
+	if err != nil {
+		return ret
+	}
+	ret.Ok = val != "" || i.s.data.setSetting(settingPresignKey, args.Key)
+	return ret
+}
+
+// storedPresignKey returns the cluster's key for signing URLs, or nil if no
+// URL has been signed yet.
+func (i *Images) storedPresignKey() ([]byte, error) {
+	val, err := i.s.data.getSetting(settingPresignKey)
+	if err != nil || val == "" {
+		return nil, err
+	}
+	return hex.DecodeString(val)
+}
+
+// presignKey returns the cluster's key for signing URLs, generating one the
+// first time it is needed.
+func (i *Images) presignKey() []byte {
+	val, err := i.s.data.getSetting(settingPresignKey)
+	if err != nil {
+		panic(err)
+	}
+	if val == "" {
+		raw := make([]byte, 32)
+		_, err = rand.Read(raw)
+		if err != nil {
+			panic(err)
+		}
+		ret := i.s.sync("presignKey", &presignKeyArgs{hex.EncodeToString(raw)})
+		if x, ok := ret.(*signatureRet); !ok || !x.Ok {
+			panic(CodeInternal)
+		}
+		val, err = i.s.data.getSetting(settingPresignKey)
+		if err != nil || val == "" {
+			panic(CodeInternal)
+		}
+	}
+	key, err := hex.DecodeString(val)
+	if err != nil {
+		panic(err)
+	}
+	return key
+}
+
+func presignMAC(key []byte, target, rev string, expires int64, ip string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(target + "\n" + rev + "\n" + strconv.FormatInt(expires, 10) + "\n" + ip))
+	return mac.Sum(nil)
+}
+
+// presign generates a URL that downloads an image, or one of its revisions,
+// without logging in. Only the image's owner may generate one. It is valid
+// for the number of seconds in the presign query, up to the configured
+// maximum, and is bound to the client address in the ip query if given.
+func (i *Images) presign(s *Session, w http.ResponseWriter, r *http.Request) {
+	target := i.target(r)
+	rules, err := i.s.data.getRules(splitPath(target))
+	if err != nil {
+		w.Write(NewFailResponse(0, "no such file").JSON())
+		return
+	}
+	if rules.Owner != s.User.Name() {
+		w.Write(ResponseAccessDenied.JSON())
+		return
+	}
+	chk, err := i.s.data.imagesGetInfo(splitPath(target))
+	if err != nil || chk == "folder" {
+		w.Write(NewFailResponse(0, "no such file").JSON())
+		return
+	}
+
+	max := int64(i.s.conf.Storage.PresignMax)
+	if max <= 0 {
+		max = defaultPresignMax
+	}
+	secs, err := strconv.ParseInt(r.URL.Query().Get("presign"), 10, 64)
+	if err != nil || secs <= 0 || secs > max {
+		w.Write(NewFailResponse(0, "bad duration").JSON())
+		return
+	}
+
+	q := r.URL.Query()
+	rev := q.Get("revision")
+	if rev != "" {
+		n, err := strconv.Atoi(rev)
+		if err != nil {
+			w.Write(ResponseNoSuchRevision.JSON())
+			return
+		}
+		path, name := splitPath(target)
+		_, err = i.s.data.imagesRevision(path, name, n)
+		if err != nil {
+			w.Write(ResponseNoSuchRevision.JSON())
+			return
+		}
+	}
+	ip := q.Get("ip")
+	if ip != "" && net.ParseIP(ip) == nil {
+		w.Write(NewFailResponse(0, "bad ip").JSON())
+		return
+	}
+
+	expires := time.Now().Unix() + secs
+	sig := presignMAC(i.presignKey(), target, rev, expires, ip)
+	query := "expires=" + strconv.FormatInt(expires, 10)
+	if rev != "" {
+		query += "&revision=" + rev
+	}
+	if ip != "" {
+		query += "&ip=" + ip
+	}
+	query += "&signature=" + hex.EncodeToString(sig)
+
+	w.Write(NewSuccessResponse(&presignPL{
+		URL:     i.s.servicesVersionString() + "/presigned" + target + "?" + query,
+		Expires: expires,
+	}).JSON())
+}
+
+// presigned serves a download through a pre-signed URL. It is reached
+// without a session, so it answers with bare status codes, and never
+// generates the signing key: until a URL has been signed none can be valid.
+func (i *Images) presigned(w http.ResponseWriter, r *http.Request) {
+	target := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, i.s.servicesVersionString()+"/presigned"), "/")
+	q := r.URL.Query()
+	rev := q.Get("revision")
+	ip := q.Get("ip")
+	expires, err := strconv.ParseInt(q.Get("expires"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	key, err := i.storedPresignKey()
+	if err != nil || key == nil {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	sig, err := hex.DecodeString(q.Get("signature"))
+	if err != nil || !hmac.Equal(sig, presignMAC(key, target, rev, expires, ip)) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if time.Now().Unix() > expires {
+		w.WriteHeader(http.StatusGone)
+		return
+	}
+	if ip != "" {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil || !net.ParseIP(host).Equal(net.ParseIP(ip)) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+	}
+
+	path, name := splitPath(target)
+	var chk string
+	var date uint64
+	if rev == "" {
+		chk, err = i.s.data.imagesGetInfo(path, name)
+		if err == nil && chk != "folder" {
+			_, _, date, _, err = i.s.data.imagesGetAttributes(path, name)
+		}
+	} else {
+		var n int
+		n, err = strconv.Atoi(rev)
+		if err == nil {
+			var x *revision
+			x, err = i.s.data.imagesRevision(path, name, n)
+			if err == nil {
+				chk, date = x.Checksum, x.Date
+			}
+		}
+	}
+	if err != nil || chk == "folder" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	i.deliver(w, r, target, chk, date)
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+const defaultQuotaWarn = 90
+
+var ResponseQuotaExceeded = NewFailResponse(0, "quota exceeded")
+
+// quotaWarnings remembers which users and groups have been warned that they
+// are close to their quota, so the journal is only told once each time the
+// threshold is crossed.
+type quotaWarnings struct {
+	lock   sync.Mutex
+	warned map[string]bool
+}
+
+type quotaArgs struct {
+	Kind    string
+	Name    string
+	Bytes   int64
+	Objects int64
+}
+
+type quotaRet struct {
+	Ok bool
+}
+
+type quotaPL struct {
+	Kind  string `json:"kind"`
+	Name  string `json:"name"`
+	Quota quota  `json:"quota"`
+	Usage quota  `json:"usage"`
+}
+
+func (i *Images) quotaSetFSM(data []byte) interface{} {
+	args := new(quotaArgs)
+	ret := new(quotaRet)
+	err := decode(data, args)
+	if err != nil {
+		return ret
+	}
+	ret.Ok = i.s.data.quotasSet(args)
+	return ret
+}
+
+// quotaTarget returns the kind and name of the user or group named in the
+// request's query.
+func quotaTarget(r *http.Request) (string, string) {
+	if val := r.URL.Query().Get("user"); val != "" {
+		return quotaUser, val
+	}
+	if val := r.URL.Query().Get("group"); val != "" {
+		return quotaGroup, val
+	}
+	return "", ""
+}
+
+// quotaSet sets the quota of a user or group. A name of "*" sets the default
+// for every user or group without a quota of their own, and zero limits
+// remove the quota.
+func (i *Images) quotaSet(s *Session, w http.ResponseWriter, r *http.Request) {
+	args := new(quotaArgs)
+	args.Kind, args.Name = quotaTarget(r)
+	if args.Kind == "" {
+		w.Write(NewFailResponse(0, "missing user or group").JSON())
+		return
+	}
+	var err error
+	if val := r.URL.Query().Get("bytes"); val != "" {
+		args.Bytes, err = strconv.ParseInt(val, 10, 64)
+		if err != nil || args.Bytes < 0 {
+			w.Write(NewFailResponse(0, "bad byte limit").JSON())
+			return
+		}
+	}
+	if val := r.URL.Query().Get("objects"); val != "" {
+		args.Objects, err = strconv.ParseInt(val, 10, 64)
+		if err != nil || args.Objects < 0 {
+			w.Write(NewFailResponse(0, "bad object limit").JSON())
+			return
+		}
+	}
+
+	ret := i.s.sync("quotaSet", args)
+	if x, ok := ret.(*quotaRet); !ok || !x.Ok {
+		w.Write(NewFailResponse(0, "").JSON())
+		return
+	}
+	w.Write(NewSuccessResponse(nil).JSON())
+}
+
+// quotaUsage reports usage against quota for the session's user and groups,
+// or for any user or group named in the query if the session may set quotas.
+func (i *Images) quotaUsage(s *Session, w http.ResponseWriter, r *http.Request) {
+	var targets [][2]string
+	if kind, name := quotaTarget(r); kind != "" {
+		own := (kind == quotaUser && name == s.User.Name()) || (kind == quotaGroup && inGroups(s, name))
+		if !own && !i.s.CanWriteFile(s, "/storage/quotas") {
+			w.Write(ResponseAccessDenied.JSON())
+			return
+		}
+		targets = append(targets, [2]string{kind, name})
+	} else {
+		targets = append(targets, [2]string{quotaUser, s.User.Name()})
+		for _, grp := range s.User.Groups() {
+			targets = append(targets, [2]string{quotaGroup, grp})
+		}
+	}
+
+	var pl []quotaPL
+	for _, t := range targets {
+		qt, usage, err := i.s.data.quotasGet(t[0], t[1])
+		if err != nil {
+			panic(err)
+		}
+		pl = append(pl, quotaPL{t[0], t[1], qt, usage})
+	}
+	w.Write(NewSuccessResponse(pl).JSON())
+}
+
+func inGroups(s *Session, group string) bool {
+	for _, grp := range s.User.Groups() {
+		if grp == group {
+			return true
+		}
+	}
+	return false
+}
+
+// warnQuotas writes a warning to the journal when a user or group crosses
+// the soft threshold of their quota.
+func (i *Images) warnQuotas(owner, group string) {
+	pct := int64(i.s.conf.Storage.QuotaWarn)
+	if pct <= 0 {
+		pct = defaultQuotaWarn
+	}
+	for _, t := range [][2]string{{quotaUser, owner}, {quotaGroup, group}} {
+		qt, usage, err := i.s.data.quotasGet(t[0], t[1])
+		if err != nil {
+			i.log.Error("couldn't check quota", "kind", t[0], "name", t[1], "error", err)
+			continue
+		}
+		over := (qt.Bytes > 0 && usage.Bytes*100 >= qt.Bytes*pct) ||
+			(qt.Objects > 0 && usage.Objects*100 >= qt.Objects*pct)
+
+		key := t[0] + ":" + t[1]
+		i.quotas.lock.Lock()
+		if i.quotas.warned == nil {
+			i.quotas.warned = make(map[string]bool)
+		}
+		warn := over && !i.quotas.warned[key]
+		if over {
+			i.quotas.warned[key] = true
+		} else {
+			delete(i.quotas.warned, key)
+		}
+		i.quotas.lock.Unlock()
+
+		if warn {
+			i.s.journal.serverLog(Warn, "STORAGE_QUOTA_WARNING", t[0]+" "+t[1]+" is close to their storage quota", map[string]string{
+				t[0]:           t[1],
+				"bytes":        strconv.FormatInt(usage.Bytes, 10),
+				"bytes_quota":  strconv.FormatInt(qt.Bytes, 10),
+				"objects":      strconv.FormatInt(usage.Objects, 10),
+				"object_quota": strconv.FormatInt(qt.Objects, 10),
+			})
+		}
+	}
+}
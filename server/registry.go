@@ -0,0 +1,745 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"regexp"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+/*
+The registry exposes the images tree through the OCI distribution (Docker
+registry v2) API. A repository "team/app" is the folder /images/team/app, so
+the usual Rules decide who may pull from and push to it. Inside it, blobs
+live in .blobs and manifests in .manifests, each named by the hex of its
+SHA-256 digest, and every tag is an image directly in the repository folder
+sharing the checksum of the manifest it points at. Since all of these are
+ordinary images, blobs are reference counted and deduplicated like any other,
+and moving a tag keeps its previous manifest as a revision.
+*/
+
+const (
+	registryBlobs        = ".blobs"
+	registryManifests    = ".manifests"
+	registryMaxManifest  = 4 << 20
+	registryDefaultPage  = 100
+	mediaTypeOCIManifest = "application/vnd.oci.image.manifest.v1+json"
+	digestPrefix         = "sha256:"
+)
+
+var (
+	registryNameRegexp = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*)*$`)
+	registryTagRegexp  = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9._-]{0,127}$`)
+)
+
+type registryHandler struct {
+	i       *Images
+	handler func(*Session, http.ResponseWriter, *http.Request)
+}
+
+type registryErrorPL struct {
+	Errors []registryErrorItem `json:"errors"`
+}
+
+type registryErrorItem struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type registryManifest struct {
+	MediaType string `json:"mediaType"`
+	Config    *struct {
+		Digest string `json:"digest"`
+	} `json:"config"`
+	Layers []struct {
+		Digest string `json:"digest"`
+	} `json:"layers"`
+	Manifests []struct {
+		Digest string `json:"digest"`
+	} `json:"manifests"`
+}
+
+func registryError(w http.ResponseWriter, status int, code, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&registryErrorPL{[]registryErrorItem{{code, msg}}})
+}
+
+// ServeHTTP authenticates requests as ProtectedHandler does before passing
+// them on. Permissions are checked by each handler, since which files a
+// request touches depends on what it asks for.
+func (h *registryHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		if x := recover(); x != nil {
+			h.i.log.Error("unexpected panic in registry", "error", x)
+			fmt.Fprintf(os.Stderr, "%v\n%s", x, debug.Stack())
+			registryError(w, http.StatusInternalServerError, "UNKNOWN", "internal error")
+		}
+	}()
+
+	w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+	s := (&ProtectedHandler{s: h.i.s}).HandlerLogin(r)
+	if s == nil {
+		w.Header().Set("WWW-Authenticate", `Basic realm="vorteil"`)
+		registryError(w, http.StatusUnauthorized, "UNAUTHORIZED", "authentication required")
+		return
+	}
+	h.handler(s, w, r)
+}
+
+func (i *Images) setupRegistryRoutes(r *mux.Router) {
+	handle := func(path string, fn func(*Session, http.ResponseWriter, *http.Request), methods ...string) {
+		r.Handle(path, &registryHandler{i, fn}).Methods(methods...)
+	}
+	handle("/", i.registryBase, "GET")
+	handle("/_catalog", i.registryCatalog, "GET")
+	handle("/{name:.+}/tags/list", i.registryTagsList, "GET")
+	handle("/{name:.+}/manifests/{reference}", i.registryGetManifest, "GET", "HEAD")
+	handle("/{name:.+}/manifests/{reference}", i.registryPutManifest, "PUT")
+	handle("/{name:.+}/manifests/{reference}", i.registryDeleteManifest, "DELETE")
+	handle("/{name:.+}/blobs/uploads/", i.registryUploadStart, "POST")
+	handle("/{name:.+}/blobs/uploads/{uuid}", i.registryUploadStatus, "GET")
+	handle("/{name:.+}/blobs/uploads/{uuid}", i.registryUploadChunk, "PATCH")
+	handle("/{name:.+}/blobs/uploads/{uuid}", i.registryUploadFinish, "PUT")
+	handle("/{name:.+}/blobs/uploads/{uuid}", i.registryUploadCancel, "DELETE")
+	handle("/{name:.+}/blobs/{digest}", i.registryGetBlob, "GET", "HEAD")
+	handle("/{name:.+}/blobs/{digest}", i.registryDeleteBlob, "DELETE")
+}
+
+func (i *Images) registryBase(s *Session, w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte("{}"))
+}
+
+// registryRepo returns the folder of the repository named in the request.
+func (i *Images) registryRepo(w http.ResponseWriter, r *http.Request) (string, bool) {
+	name := mux.Vars(r)["name"]
+	if !registryNameRegexp.MatchString(name) {
+		registryError(w, http.StatusBadRequest, "NAME_INVALID", "invalid repository name")
+		return "", false
+	}
+	return "/images/" + name, true
+}
+
+func parseDigest(digest string) (string, bool) {
+	if !strings.HasPrefix(digest, digestPrefix) {
+		return "", false
+	}
+	chk, err := parseBlobReference(digest)
+	return chk, err == nil
+}
+
+// registryCanPush reports whether the session may create files in the
+// repository, creating the repository itself if need be.
+func (i *Images) registryCanPush(s *Session, repo string) bool {
+	return i.s.CanWriteFile(s, i.s.data.existingAncestor(repo+"/"+registryManifests+"/x"))
+}
+
+// registryCommit records chk as the contents of the image at target,
+// creating it and any missing folders above it, or overwriting it if it
+// exists with different contents.
+func (i *Images) registryCommit(s *Session, target, chk string, size int64, meta *blobMeta, reserved bool) error {
+	path, name := splitPath(target)
+	fn := "imagesUpload"
+	if cur, err := i.s.data.imagesGetInfo(path, name); err == nil {
+		if cur == chk {
+			if reserved {
+				i.release(chk)
+			}
+			return nil
+		}
+		fn = "imagesUploadOW"
+		if cur == "folder" || !i.s.CanWriteFile(s, target) {
+			if reserved {
+				i.release(chk)
+			}
+			return errAccessDenied
+		}
+	}
+
+	ul := &uploadData{
+		Owner:    s.User.Name(),
+		Group:    s.User.PrimaryGroup(),
+		Mode:     s.Mode(),
+		Target:   target,
+		Parents:  true,
+		Checksum: chk,
+		Reserved: reserved,
+		Size:     size,
+		Meta:     meta,
+		KeepLast: i.s.conf.Storage.Revisions.KeepLast,
+		KeepDays: i.s.conf.Storage.Revisions.KeepDays,
+		Now:      time.Now().Unix(),
+	}
+	if reserved {
+		ul.Node = i.s.conf.Advertise
+	}
+	return i.apply(fn, ul)
+}
+
+func (i *Images) registryCommitError(w http.ResponseWriter, err error) {
+	switch err {
+	case errAccessDenied:
+		registryError(w, http.StatusForbidden, "DENIED", "access denied")
+	case errQuotaExceeded:
+		registryError(w, http.StatusForbidden, "DENIED", "quota exceeded")
+	default:
+		registryError(w, http.StatusInternalServerError, "UNKNOWN", "couldn't commit")
+	}
+}
+
+// registryServe writes the blob an image holds, refusing if the image is in
+// a protected folder without a trusted signature.
+func (i *Images) registryServe(w http.ResponseWriter, r *http.Request, target, chk, contentType string) {
+	if !i.holds(chk) {
+		registryError(w, http.StatusServiceUnavailable, "UNKNOWN", "blob not yet replicated to this node")
+		return
+	}
+	if i.s.data.imagesProtected(target) && !i.verified(target, chk) {
+		registryError(w, http.StatusForbidden, "DENIED", "image has no trusted signature")
+		return
+	}
+	file, err := i.storage().Get(chk)
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Docker-Content-Digest", digestPrefix+chk)
+	w.Header().Set("ETag", "\""+digestPrefix+chk+"\"")
+	http.ServeContent(w, r, "", time.Time{}, file)
+}
+
+func (i *Images) registryGetBlob(s *Session, w http.ResponseWriter, r *http.Request) {
+	repo, ok := i.registryRepo(w, r)
+	if !ok {
+		return
+	}
+	chk, ok := parseDigest(mux.Vars(r)["digest"])
+	if !ok {
+		registryError(w, http.StatusBadRequest, "DIGEST_INVALID", "invalid digest")
+		return
+	}
+	target := repo + "/" + registryBlobs + "/" + chk
+	if _, err := i.s.data.imagesGetInfo(splitPath(target)); err != nil {
+		registryError(w, http.StatusNotFound, "BLOB_UNKNOWN", "blob unknown to registry")
+		return
+	}
+	if !i.s.CanReadFile(s, target) {
+		registryError(w, http.StatusForbidden, "DENIED", "access denied")
+		return
+	}
+	i.registryServe(w, r, target, chk, "application/octet-stream")
+}
+
+func (i *Images) registryDeleteBlob(s *Session, w http.ResponseWriter, r *http.Request) {
+	repo, ok := i.registryRepo(w, r)
+	if !ok {
+		return
+	}
+	chk, ok := parseDigest(mux.Vars(r)["digest"])
+	if !ok {
+		registryError(w, http.StatusBadRequest, "DIGEST_INVALID", "invalid digest")
+		return
+	}
+	if !i.registryDelete(s, w, repo+"/"+registryBlobs+"/"+chk) {
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// registryDelete removes a single image, writing an error response and
+// returning false if it can't.
+func (i *Images) registryDelete(s *Session, w http.ResponseWriter, target string) bool {
+	path, _ := splitPath(target)
+	if !i.s.CanWriteFile(s, path) {
+		registryError(w, http.StatusForbidden, "DENIED", "access denied")
+		return false
+	}
+	ret := i.s.sync("imagesDelete", &imgDeleteArgs{target, false})
+	x, ok := ret.(*imgDeleteRet)
+	if !ok || !x.Ok || x.Response != "SUCCESS" {
+		registryError(w, http.StatusNotFound, "BLOB_UNKNOWN", "unknown to registry")
+		return false
+	}
+	i.collect(x.Delete)
+	return true
+}
+
+// registryOpenUpload loads the upload session named in the request and
+// marks it as busy, as openUpload does for the images API.
+func (i *Images) registryOpenUpload(s *Session, w http.ResponseWriter, r *http.Request, repo string) *uploadSession {
+	id := mux.Vars(r)["uuid"]
+	if !validUploadID(id) {
+		registryError(w, http.StatusNotFound, "BLOB_UPLOAD_UNKNOWN", "upload unknown")
+		return nil
+	}
+	if !i.uploads.acquire(id) {
+		registryError(w, http.StatusConflict, "BLOB_UPLOAD_INVALID", "upload is busy")
+		return nil
+	}
+	info, err := ioutil.ReadFile(i.uploads.infoPath(id))
+	if err != nil {
+		i.uploads.release(id)
+		registryError(w, http.StatusNotFound, "BLOB_UPLOAD_UNKNOWN", "upload unknown")
+		return nil
+	}
+	sess := new(uploadSession)
+	err = json.Unmarshal(info, sess)
+	if err != nil {
+		panic(err)
+	}
+	if sess.Data.Owner != s.User.Name() || sess.Data.Target != repo {
+		i.uploads.release(id)
+		registryError(w, http.StatusNotFound, "BLOB_UPLOAD_UNKNOWN", "upload unknown")
+		return nil
+	}
+	return sess
+}
+
+func (i *Images) registryUploadHeaders(w http.ResponseWriter, r *http.Request, id string, size int64) {
+	w.Header().Set("Location", "/v2/"+mux.Vars(r)["name"]+"/blobs/uploads/"+id)
+	w.Header().Set("Docker-Upload-UUID", id)
+	end := size - 1
+	if end < 0 {
+		end = 0
+	}
+	w.Header().Set("Range", "0-"+strconv.FormatInt(end, 10))
+	w.Header().Set("Content-Length", "0")
+}
+
+// registryUploadStart starts a blob upload. If the request carries a digest
+// the body is the whole blob and is committed straight away.
+func (i *Images) registryUploadStart(s *Session, w http.ResponseWriter, r *http.Request) {
+	repo, ok := i.registryRepo(w, r)
+	if !ok {
+		return
+	}
+	if !i.registryCanPush(s, repo) {
+		registryError(w, http.StatusForbidden, "DENIED", "access denied")
+		return
+	}
+
+	if digest := r.URL.Query().Get("digest"); digest != "" {
+		expected, ok := parseDigest(digest)
+		if !ok {
+			registryError(w, http.StatusBadRequest, "DIGEST_INVALID", "invalid digest")
+			return
+		}
+		tmp, sums, err := i.stage(r.Body)
+		if err != nil {
+			panic(err)
+		}
+		i.registryFinishBlob(s, w, r, repo, expected, tmp, sums.size)
+		return
+	}
+
+	sess := &uploadSession{
+		Created: time.Now().Unix(),
+		Data:    uploadData{Owner: s.User.Name(), Group: s.User.PrimaryGroup(), Target: repo},
+	}
+	i.uploads.create(sess)
+
+	i.registryUploadHeaders(w, r, sess.ID, 0)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (i *Images) registryUploadStatus(s *Session, w http.ResponseWriter, r *http.Request) {
+	repo, ok := i.registryRepo(w, r)
+	if !ok {
+		return
+	}
+	sess := i.registryOpenUpload(s, w, r, repo)
+	if sess == nil {
+		return
+	}
+	defer i.uploads.release(sess.ID)
+
+	size, err := i.uploads.size(sess.ID)
+	if err != nil {
+		panic(err)
+	}
+	i.registryUploadHeaders(w, r, sess.ID, size)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// registryAppend adds the body of the request to an upload, checking any
+// Content-Range header against what has been received so far.
+func (i *Images) registryAppend(w http.ResponseWriter, r *http.Request, sess *uploadSession) (int64, bool) {
+	size, err := i.uploads.size(sess.ID)
+	if err != nil {
+		panic(err)
+	}
+	if val := r.Header.Get("Content-Range"); val != "" {
+		x := strings.SplitN(strings.TrimPrefix(val, "bytes "), "-", 2)
+		start, err := strconv.ParseInt(x[0], 10, 64)
+		if err != nil || start != size {
+			i.registryUploadHeaders(w, r, sess.ID, size)
+			registryError(w, http.StatusRequestedRangeNotSatisfiable, "BLOB_UPLOAD_INVALID", "bad content range")
+			return 0, false
+		}
+	}
+
+	file, err := os.OpenFile(i.uploads.dataPath(sess.ID), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		panic(err)
+	}
+	n, err := io.Copy(file, r.Body)
+	file.Close()
+	if err != nil {
+		i.log.Debug("registry upload chunk interrupted", "upload", sess.ID, "error", err)
+	}
+	return size + n, true
+}
+
+func (i *Images) registryUploadChunk(s *Session, w http.ResponseWriter, r *http.Request) {
+	repo, ok := i.registryRepo(w, r)
+	if !ok {
+		return
+	}
+	sess := i.registryOpenUpload(s, w, r, repo)
+	if sess == nil {
+		return
+	}
+	defer i.uploads.release(sess.ID)
+
+	size, ok := i.registryAppend(w, r, sess)
+	if !ok {
+		return
+	}
+	i.registryUploadHeaders(w, r, sess.ID, size)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (i *Images) registryUploadFinish(s *Session, w http.ResponseWriter, r *http.Request) {
+	repo, ok := i.registryRepo(w, r)
+	if !ok {
+		return
+	}
+	sess := i.registryOpenUpload(s, w, r, repo)
+	if sess == nil {
+		return
+	}
+	defer i.uploads.release(sess.ID)
+
+	expected, ok := parseDigest(r.URL.Query().Get("digest"))
+	if !ok {
+		registryError(w, http.StatusBadRequest, "DIGEST_INVALID", "invalid digest")
+		return
+	}
+	size, ok := i.registryAppend(w, r, sess)
+	if !ok {
+		return
+	}
+
+	// move the data out of the session so it can be handed to storage
+	tmp, err := ioutil.TempFile(i.tmpDir(), "img")
+	if err != nil {
+		panic(err)
+	}
+	tmp.Close()
+	err = os.Rename(i.uploads.dataPath(sess.ID), tmp.Name())
+	if err != nil {
+		panic(err)
+	}
+	os.RemoveAll(i.uploads.dir + "/" + sess.ID)
+	i.registryFinishBlob(s, w, r, repo, expected, tmp.Name(), size)
+}
+
+// registryFinishBlob verifies a staged blob against the digest the client
+// claimed, stores it and records it in the repository.
+func (i *Images) registryFinishBlob(s *Session, w http.ResponseWriter, r *http.Request, repo, expected, tmp string, size int64) {
+	file, err := os.Open(tmp)
+	if err != nil {
+		panic(err)
+	}
+	sha := sha256.New()
+	_, err = io.Copy(sha, file)
+	file.Close()
+	if err != nil {
+		panic(err)
+	}
+	if hex.EncodeToString(sha.Sum(nil)) != expected {
+		os.Remove(tmp)
+		registryError(w, http.StatusBadRequest, "DIGEST_INVALID", "digest did not match content")
+		return
+	}
+
+	meta := detectFormat(tmp, size)
+	err = i.store(tmp, expected)
+	if err != nil {
+		panic(err)
+	}
+	err = i.registryCommit(s, repo+"/"+registryBlobs+"/"+expected, expected, size, meta, true)
+	if err != nil {
+		i.registryCommitError(w, err)
+		return
+	}
+
+	w.Header().Set("Location", "/v2/"+mux.Vars(r)["name"]+"/blobs/"+digestPrefix+expected)
+	w.Header().Set("Docker-Content-Digest", digestPrefix+expected)
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (i *Images) registryUploadCancel(s *Session, w http.ResponseWriter, r *http.Request) {
+	repo, ok := i.registryRepo(w, r)
+	if !ok {
+		return
+	}
+	sess := i.registryOpenUpload(s, w, r, repo)
+	if sess == nil {
+		return
+	}
+	defer i.uploads.release(sess.ID)
+
+	err := os.RemoveAll(i.uploads.dir + "/" + sess.ID)
+	if err != nil {
+		panic(err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// registryManifestTarget returns the image a manifest reference, either a
+// tag or a digest, resolves to in a repository.
+func registryManifestTarget(repo, reference string) (string, bool) {
+	if chk, ok := parseDigest(reference); ok {
+		return repo + "/" + registryManifests + "/" + chk, true
+	}
+	if registryTagRegexp.MatchString(reference) {
+		return repo + "/" + reference, true
+	}
+	return "", false
+}
+
+func (i *Images) registryGetManifest(s *Session, w http.ResponseWriter, r *http.Request) {
+	repo, ok := i.registryRepo(w, r)
+	if !ok {
+		return
+	}
+	target, ok := registryManifestTarget(repo, mux.Vars(r)["reference"])
+	if !ok {
+		registryError(w, http.StatusBadRequest, "TAG_INVALID", "invalid reference")
+		return
+	}
+	chk, err := i.s.data.imagesGetInfo(splitPath(target))
+	if err != nil || chk == "folder" {
+		registryError(w, http.StatusNotFound, "MANIFEST_UNKNOWN", "manifest unknown")
+		return
+	}
+	if !i.s.CanReadFile(s, target) {
+		registryError(w, http.StatusForbidden, "DENIED", "access denied")
+		return
+	}
+	contentType := mediaTypeOCIManifest
+	if _, meta, err := i.s.data.blobsMeta(chk); err == nil && meta != nil {
+		contentType = meta.ContentType
+	}
+	i.registryServe(w, r, target, chk, contentType)
+}
+
+// registryPutManifest stores a manifest under its digest after checking
+// that every blob or manifest it refers to is already in the repository,
+// then points the tag at it if it was pushed by tag.
+func (i *Images) registryPutManifest(s *Session, w http.ResponseWriter, r *http.Request) {
+	repo, ok := i.registryRepo(w, r)
+	if !ok {
+		return
+	}
+	reference := mux.Vars(r)["reference"]
+	if _, ok := registryManifestTarget(repo, reference); !ok {
+		registryError(w, http.StatusBadRequest, "TAG_INVALID", "invalid reference")
+		return
+	}
+	if !i.registryCanPush(s, repo) {
+		registryError(w, http.StatusForbidden, "DENIED", "access denied")
+		return
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, registryMaxManifest+1))
+	if err != nil {
+		panic(err)
+	}
+	if len(body) > registryMaxManifest {
+		registryError(w, http.StatusRequestEntityTooLarge, "SIZE_INVALID", "manifest too large")
+		return
+	}
+	manifest := new(registryManifest)
+	err = json.Unmarshal(body, manifest)
+	if err != nil {
+		registryError(w, http.StatusBadRequest, "MANIFEST_INVALID", "manifest invalid")
+		return
+	}
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if contentType == "" {
+		contentType = manifest.MediaType
+	}
+	if contentType == "" {
+		contentType = mediaTypeOCIManifest
+	}
+
+	var refs []string
+	if manifest.Config != nil {
+		refs = append(refs, registryBlobs+"/"+manifest.Config.Digest)
+	}
+	for _, l := range manifest.Layers {
+		refs = append(refs, registryBlobs+"/"+l.Digest)
+	}
+	for _, m := range manifest.Manifests {
+		refs = append(refs, registryManifests+"/"+m.Digest)
+	}
+	for _, ref := range refs {
+		dir, digest := splitPath(ref)
+		chk, ok := parseDigest(digest)
+		if !ok {
+			registryError(w, http.StatusBadRequest, "MANIFEST_INVALID", "invalid digest in manifest")
+			return
+		}
+		if _, err := i.s.data.imagesGetInfo(repo+"/"+dir, chk); err != nil {
+			registryError(w, http.StatusBadRequest, "MANIFEST_BLOB_UNKNOWN", "blob unknown to registry: "+digest)
+			return
+		}
+	}
+
+	tmp, sums, err := i.stage(bytes.NewReader(body))
+	if err != nil {
+		panic(err)
+	}
+	chk := sums.checksum()
+	if expected, ok := parseDigest(reference); ok && expected != chk {
+		os.Remove(tmp)
+		registryError(w, http.StatusBadRequest, "DIGEST_INVALID", "digest did not match content")
+		return
+	}
+	err = i.store(tmp, chk)
+	if err != nil {
+		panic(err)
+	}
+	meta := &blobMeta{ContentType: contentType, Format: "manifest"}
+	err = i.registryCommit(s, repo+"/"+registryManifests+"/"+chk, chk, sums.size, meta, true)
+	if err != nil {
+		i.registryCommitError(w, err)
+		return
+	}
+	if _, ok := parseDigest(reference); !ok {
+		err = i.registryCommit(s, repo+"/"+reference, chk, sums.size, nil, false)
+		if err != nil {
+			i.registryCommitError(w, err)
+			return
+		}
+	}
+
+	w.Header().Set("Location", "/v2/"+mux.Vars(r)["name"]+"/manifests/"+digestPrefix+chk)
+	w.Header().Set("Docker-Content-Digest", digestPrefix+chk)
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(http.StatusCreated)
+}
+
+// registryDeleteManifest removes a tag, or a manifest along with every tag
+// pointing at it.
+func (i *Images) registryDeleteManifest(s *Session, w http.ResponseWriter, r *http.Request) {
+	repo, ok := i.registryRepo(w, r)
+	if !ok {
+		return
+	}
+	reference := mux.Vars(r)["reference"]
+	target, ok := registryManifestTarget(repo, reference)
+	if !ok {
+		registryError(w, http.StatusBadRequest, "TAG_INVALID", "invalid reference")
+		return
+	}
+	if chk, ok := parseDigest(reference); ok {
+		tags, err := i.s.data.registryTags(repo, chk)
+		if err != nil {
+			panic(err)
+		}
+		for _, tag := range tags {
+			if !i.registryDelete(s, w, repo+"/"+tag) {
+				return
+			}
+		}
+	}
+	if !i.registryDelete(s, w, target) {
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// registryPage applies the n and last pagination parameters to a sorted
+// list, setting a Link header for the next page if there is one.
+func registryPage(w http.ResponseWriter, r *http.Request, list []string) []string {
+	q := r.URL.Query()
+	if last := q.Get("last"); last != "" {
+		start := 0
+		for start < len(list) && list[start] <= last {
+			start++
+		}
+		list = list[start:]
+	}
+	n := registryDefaultPage
+	if val, err := strconv.Atoi(q.Get("n")); err == nil && val > 0 {
+		n = val
+	}
+	if len(list) > n {
+		list = list[:n]
+		w.Header().Set("Link", "<"+r.URL.Path+"?n="+strconv.Itoa(n)+"&last="+list[n-1]+">; rel=\"next\"")
+	}
+	if list == nil {
+		list = []string{}
+	}
+	return list
+}
+
+func (i *Images) registryTagsList(s *Session, w http.ResponseWriter, r *http.Request) {
+	repo, ok := i.registryRepo(w, r)
+	if !ok {
+		return
+	}
+	if chk, err := i.s.data.imagesGetInfo(splitPath(repo)); err != nil || chk != "folder" {
+		registryError(w, http.StatusNotFound, "NAME_UNKNOWN", "repository name not known to registry")
+		return
+	}
+	if !i.s.CanReadFile(s, repo) {
+		registryError(w, http.StatusForbidden, "DENIED", "access denied")
+		return
+	}
+	tags, err := i.s.data.registryTags(repo, "")
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"name": mux.Vars(r)["name"],
+		"tags": registryPage(w, r, tags),
+	})
+}
+
+func (i *Images) registryCatalog(s *Session, w http.ResponseWriter, r *http.Request) {
+	repos, err := i.s.data.registryRepositories()
+	if err != nil {
+		panic(err)
+	}
+	var visible []string
+	for _, repo := range repos {
+		if i.s.CanReadFile(s, repo) {
+			visible = append(visible, strings.TrimPrefix(repo, "/images/"))
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"repositories": registryPage(w, r, visible),
+	})
+}
@@ -0,0 +1,303 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultReplicationInterval = 30
+	secretHeader               = "X-Vorteil-Secret"
+)
+
+var (
+	ResponseNotReplicated = NewFailResponse(0, "image not yet replicated to this node")
+
+	errReplicaChecksum = errors.New("replica checksum mismatch")
+	errReplicaFetch    = errors.New("couldn't fetch replica from any holder")
+)
+
+// replicationConfiguration controls copying blobs between nodes that use
+// local storage. Each blob is held by Factor nodes, or by every node if
+// Factor isn't positive, and nodes authenticate to each other using Secret.
+type replicationConfiguration struct {
+	Enabled  bool   `yaml:"enabled"`
+	Factor   int    `yaml:"factor"`
+	Secret   string `yaml:"secret"`
+	Interval int    `yaml:"interval"`
+}
+
+/*
+replicator fetches the blobs a node is responsible for from the peers that
+hold them. Metadata reaches every node through raft, but with local storage
+the bytes only reach the node that accepted the upload, so until a node has
+fetched every blob placed on it, it reports itself as not ready.
+*/
+type replicator struct {
+	lock    sync.Mutex
+	ready   bool
+	pending int
+	client  *http.Client
+}
+
+type nodeArgs struct {
+	Addr string
+}
+
+type holdArgs struct {
+	Checksum string
+	Node     string
+}
+
+type readyPL struct {
+	Ready   bool `json:"ready"`
+	Pending int  `json:"pending"`
+}
+
+func (i *Images) nodeJoinFSM(data []byte) interface{} {
+	args := new(nodeArgs)
+	ret := new(blobRet)
+	err := decode(data, args)
+	if err != nil {
+		return ret
+	}
+	ret.Ok = i.s.data.nodesJoin(args.Addr)
+	return ret
+}
+
+func (i *Images) blobHeldFSM(data []byte) interface{} {
+	args := new(holdArgs)
+	ret := new(blobRet)
+	err := decode(data, args)
+	if err != nil {
+		return ret
+	}
+	ret.Ok = i.s.data.blobsHold(args.Checksum, args.Node)
+	return ret
+}
+
+// replicating reports whether blobs need copying between nodes, which is
+// only the case when each node keeps them on its own disk.
+func (i *Images) replicating() bool {
+	mode := i.storageMode()
+	return (mode == "local" || mode == "sharded") && i.s.conf.Storage.Replication.Enabled
+}
+
+// holds reports whether this node's storage has the blob chk.
+func (i *Images) holds(chk string) bool {
+	_, err := i.storage().Stat(chk)
+	return err == nil
+}
+
+// heldLocally returns the blobs the database records this node as holding,
+// or nil if blobs aren't replicated.
+func (i *Images) heldLocally() map[string]bool {
+	if !i.replicating() {
+		return nil
+	}
+	_, holders, err := i.s.data.replicationState()
+	if err != nil {
+		return nil
+	}
+	held := make(map[string]bool)
+	for chk, nodes := range holders {
+		for _, node := range nodes {
+			if node == i.s.conf.Advertise {
+				held[chk] = true
+			}
+		}
+	}
+	return held
+}
+
+func (i *Images) startReplication() {
+	if !i.replicating() {
+		i.repl.lock.Lock()
+		i.repl.ready = true
+		i.repl.lock.Unlock()
+		return
+	}
+	i.repl.client = &http.Client{}
+	ret := i.s.sync("nodeJoin", &nodeArgs{i.s.conf.Advertise})
+	if x, ok := ret.(*blobRet); !ok || !x.Ok {
+		i.log.Error("failed to announce node for replication")
+	}
+	go i.replicationLoop()
+}
+
+func (i *Images) replicationLoop() {
+	interval := i.s.conf.Storage.Replication.Interval
+	if interval <= 0 {
+		interval = defaultReplicationInterval
+	}
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	for {
+		i.replicate()
+		<-ticker.C
+	}
+}
+
+// placement returns the nodes responsible for holding chk, chosen by
+// rendezvous hashing so that every node agrees without coordination and
+// few blobs move when nodes join.
+func placement(nodes []string, chk string, factor int) []string {
+	if factor <= 0 || factor >= len(nodes) {
+		return nodes
+	}
+	scores := make(map[string]uint64)
+	for _, node := range nodes {
+		sum := sha256.Sum256([]byte(node + "/" + chk))
+		scores[node] = binary.BigEndian.Uint64(sum[:8])
+	}
+	ranked := make([]string, len(nodes))
+	copy(ranked, nodes)
+	sort.Slice(ranked, func(a, b int) bool {
+		return scores[ranked[a]] > scores[ranked[b]]
+	})
+	return ranked[:factor]
+}
+
+// replicate runs a single replication pass, fetching every blob placed on
+// this node that it doesn't yet hold.
+func (i *Images) replicate() {
+	defer func() {
+		if r := recover(); r != nil {
+			i.log.Error("blob replication failed", "error", r)
+		}
+	}()
+
+	nodes, holders, err := i.s.data.replicationState()
+	if err != nil {
+		i.log.Error("couldn't read replication state", "error", err)
+		return
+	}
+
+	self := i.s.conf.Advertise
+	pending := 0
+	for chk, peers := range holders {
+		assigned := false
+		for _, node := range placement(nodes, chk, i.s.conf.Storage.Replication.Factor) {
+			if node == self {
+				assigned = true
+			}
+		}
+		recorded := false
+		for _, node := range peers {
+			if node == self {
+				recorded = true
+			}
+		}
+
+		if i.holds(chk) {
+			if !recorded {
+				i.s.sync("blobHeld", &holdArgs{chk, self})
+			}
+			continue
+		}
+		if !assigned {
+			continue
+		}
+		err = i.fetch(chk, peers)
+		if err != nil {
+			i.log.Debug("couldn't replicate blob", "checksum", chk, "error", err)
+			pending++
+		}
+	}
+
+	i.repl.lock.Lock()
+	i.repl.pending = pending
+	i.repl.ready = pending == 0
+	i.repl.lock.Unlock()
+}
+
+// fetch copies chk from a peer into this node's storage and records the node
+// as holding it.
+func (i *Images) fetch(chk string, peers []string) error {
+	err := i.fetchInto(i.storage(), chk, peers)
+	if err != nil {
+		return err
+	}
+	i.s.sync("blobHeld", &holdArgs{chk, i.s.conf.Advertise})
+	return nil
+}
+
+// fetchInto copies chk from the first peer that can supply it, verifying its
+// checksum before putting it in dest.
+func (i *Images) fetchInto(dest storage, chk string, peers []string) error {
+	for _, peer := range peers {
+		if peer == i.s.conf.Advertise {
+			continue
+		}
+		req, err := http.NewRequest("GET", "http://"+peer+i.s.servicesVersionString()+"/blobs/"+chk, nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set(secretHeader, i.s.conf.Storage.Replication.Secret)
+		resp, err := i.repl.client.Do(req)
+		if err != nil {
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			continue
+		}
+		tmp, sums, err := i.stage(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			continue
+		}
+		if sums.checksum() != chk {
+			os.Remove(tmp)
+			return errReplicaChecksum
+		}
+		err = dest.Put(chk, tmp)
+		if err != nil {
+			os.Remove(tmp)
+			return err
+		}
+		return nil
+	}
+	return errReplicaFetch
+}
+
+// peerBlob serves a blob from this node's storage to another node.
+func (i *Images) peerBlob(w http.ResponseWriter, r *http.Request) {
+	secret := i.s.conf.Storage.Replication.Secret
+	given := r.Header.Get(secretHeader)
+	if !i.replicating() || secret == "" || subtle.ConstantTimeCompare([]byte(given), []byte(secret)) != 1 {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	chk := mux.Vars(r)["chk"]
+	if _, err := parseBlobReference(chk); err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	file, err := i.storage().Get(chk)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+	http.ServeContent(w, r, chk, time.Time{}, file)
+}
+
+// ready reports whether this node holds every blob placed on it.
+func (i *Images) ready(w http.ResponseWriter, r *http.Request) {
+	i.repl.lock.Lock()
+	pl := &readyPL{i.repl.ready, i.repl.pending}
+	i.repl.lock.Unlock()
+	if !pl.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(NewSuccessResponse(pl).JSON())
+}
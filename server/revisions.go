@@ -0,0 +1,107 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ResponseNoSuchRevision = NewFailResponse(0, "no such revision")
+
+// RevisionsConfiguration limits how many old revisions of an image are kept.
+// The limits are applied when an image is overwritten and again on every
+// garbage collection pass, so revisions expire even if their image is never
+// touched again. Zero limits keep revisions forever.
+type revisionsConfiguration struct {
+	KeepLast int `yaml:"keep_last"`
+	KeepDays int `yaml:"keep_days"`
+}
+
+func (i *Images) listRevisions(s *Session, w http.ResponseWriter, r *http.Request) {
+	path, name := splitPath(strings.TrimPrefix(r.URL.Path, i.s.servicesVersionString()))
+	revs, err := i.s.data.imagesRevisions(path, name)
+	if err != nil {
+		w.Write(NewFailResponse(0, "no such file").JSON())
+		return
+	}
+	w.Write(NewSuccessResponse(revs).JSON())
+}
+
+// revision looks up the revision named in the request's query.
+func (i *Images) revision(r *http.Request) *revision {
+	path, name := splitPath(strings.TrimPrefix(r.URL.Path, i.s.servicesVersionString()))
+	n, err := strconv.Atoi(r.URL.Query().Get("revision"))
+	if val := r.URL.Query().Get("rollback"); val != "" {
+		n, err = strconv.Atoi(val)
+	}
+	if err != nil {
+		return nil
+	}
+	rev, err := i.s.data.imagesRevision(path, name, n)
+	if err != nil {
+		return nil
+	}
+	return rev
+}
+
+func (i *Images) readRevision(s *Session, w http.ResponseWriter, r *http.Request) {
+	rev := i.revision(r)
+	if rev == nil {
+		w.Write(ResponseNoSuchRevision.JSON())
+		return
+	}
+	target := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, i.s.servicesVersionString()), "/")
+	i.deliver(w, r, target, rev.Checksum, rev.Date)
+}
+
+// rollback makes an old revision the current contents of an image. The
+// contents it replaces become a new revision, so a rollback can itself be
+// rolled back.
+func (i *Images) rollback(s *Session, w http.ResponseWriter, r *http.Request) {
+	rev := i.revision(r)
+	if rev == nil {
+		w.Write(ResponseNoSuchRevision.JSON())
+		return
+	}
+	ul := i.makeUploadStruct(s, r)
+	ul.Checksum = rev.Checksum
+	ul.Author, ul.AuthSet = rev.Author, true
+	ul.Description, ul.DescSet = rev.Description, true
+	ul.Time, ul.TimeSet = rev.Date, true
+	i.commit(w, "imagesUploadOW", ul)
+}
+
+func (i *Images) revisionsPruneFSM(data []byte) interface{} {
+	args := new(uploadData)
+	ret := new(uploadRet)
+	err := decode(data, args)
+	if err != nil {
+		return ret
+	}
+	ret.Delete, err = i.s.data.revisionsPrune(args)
+	ret.Ok = err == nil
+	return ret
+}
+
+// pruneRevisions drops revisions that have outlived the retention limits and
+// collects the blobs they leave unreferenced.
+func (i *Images) pruneRevisions() {
+	keep := i.s.conf.Storage.Revisions
+	if keep.KeepLast <= 0 && keep.KeepDays <= 0 {
+		return
+	}
+	ret := i.s.sync("revisionsPrune", &uploadData{
+		KeepLast: keep.KeepLast,
+		KeepDays: keep.KeepDays,
+		Now:      time.Now().Unix(),
+	})
+	x, ok := ret.(*uploadRet)
+	if !ok || !x.Ok {
+		i.log.Error("failed to prune revisions")
+		return
+	}
+	if len(x.Delete) > 0 {
+		i.collect(x.Delete)
+	}
+}
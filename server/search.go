@@ -0,0 +1,120 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultSearchLength = 100
+	maxSearchLength     = 1000
+	maxSearchScan       = 10000
+)
+
+var ResponseBadSearch = NewFailResponse(0, "bad search query")
+
+type searchPL struct {
+	Results []searchResult `json:"results"`
+	Next    string         `json:"next,omitempty"`
+}
+
+// search looks for files and folders anywhere beneath the requested folder
+// that the session can read. The search query is a full-text query over
+// names, descriptions, authors and labels, and can be narrowed with author,
+// type, label ("key=value"), after, before (unix times), min_size and
+// max_size. Results are sorted by sort (path, name, date, size or author)
+// in order (asc or desc) and paged with length, passing the next cursor of
+// one page as the cursor of the request for the next. No more than
+// maxSearchScan matches are looked through for a page, so where most are
+// hidden in folders the session can't enter a page may hold fewer results
+// than asked for, or none, even though a next cursor is returned.
+func (i *Images) search(s *Session, w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	args := &searchArgs{
+		Query:  q.Get("search"),
+		Author: q.Get("author"),
+		Type:   q.Get("type"),
+		Sort:   q.Get("sort"),
+		Desc:   strings.ToLower(q.Get("order")) == "desc",
+		Reader: s,
+	}
+	for _, val := range q["label"] {
+		x := strings.SplitN(val, "=", 2)
+		if len(x) != 2 || x[0] == "" {
+			w.Write(NewFailResponse(0, errBadLabel.Error()).JSON())
+			return
+		}
+		if args.Labels == nil {
+			args.Labels = make(map[string]string)
+		}
+		args.Labels[x[0]] = x[1]
+	}
+
+	var err error
+	parse := func(key string, fn func(string) error) {
+		if val := q.Get(key); val != "" && err == nil {
+			err = fn(val)
+		}
+	}
+	parse("after", func(val string) (e error) { args.After, e = strconv.ParseUint(val, 10, 64); return })
+	parse("before", func(val string) (e error) { args.Before, e = strconv.ParseUint(val, 10, 64); return })
+	parse("min_size", func(val string) (e error) { args.MinSize, e = strconv.ParseInt(val, 10, 64); return })
+	parse("max_size", func(val string) (e error) { args.MaxSize, e = strconv.ParseInt(val, 10, 64); return })
+	length := defaultSearchLength
+	parse("length", func(val string) (e error) { length, e = strconv.Atoi(val); return })
+	parse("cursor", func(val string) (e error) { args.Cursor, e = decodeCursor(val); return })
+	if err != nil || length <= 0 {
+		w.Write(ResponseBadSearch.JSON())
+		return
+	}
+	if length > maxSearchLength {
+		length = maxSearchLength
+	}
+
+	// the results' own permissions are checked by the query, but whether
+	// the folders above them can be traversed is checked here, remembering
+	// the answer for each folder so every folder is looked up only once
+	enter := make(map[string]bool)
+	var canEnter func(folder string) bool
+	canEnter = func(folder string) bool {
+		ok, seen := enter[folder]
+		if seen {
+			return ok
+		}
+		path, name := splitPath(folder)
+		rules, err := i.s.data.getRules(path, name)
+		ok = err == nil && s.CanExec(rules)
+		if ok && folder != "" {
+			ok = canEnter(path)
+		}
+		enter[folder] = ok
+		return ok
+	}
+	visible := func(p string) bool {
+		dir, _ := splitPath(p)
+		return canEnter(dir)
+	}
+
+	path, name := splitPath(strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, i.s.servicesVersionString()), "/"))
+	results, next, err := i.s.data.imagesSearch(path, name, args, length, visible)
+	if err == errBadSearch {
+		w.Write(ResponseBadSearch.JSON())
+		return
+	}
+	if err == errBadCursor {
+		w.Write(ResponseBadCursor.JSON())
+		return
+	}
+	if err != nil {
+		panic(err)
+	}
+	if results == nil {
+		results = []searchResult{}
+	}
+	pl := &searchPL{Results: results}
+	if next != nil {
+		pl.Next = encodeCursor(next)
+	}
+	w.Write(NewSuccessResponse(pl).JSON())
+}
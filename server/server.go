@@ -45,6 +45,9 @@ func (s *Server) Start() {
 		s.started = true
 		s.failOnError(s.raft.start(), "starting raft server")
 		s.failOnError(s.web.start(), "starting web server")
+		s.images.startReplication()
+		s.images.resumeMigration()
+		s.images.startMirrors()
 		s.log.Info("Vorteil started")
 	}
 }
@@ -86,8 +89,23 @@ func (s *Server) setupRoutes() {
 	s.failOnError(s.data.insertFile("service", "/messages/ws", "all", r), "adding files to database")
 
 	// Images
+	s.failOnError(s.data.insertFile("folder", "", "images", r), "adding files to database")
 	s.images.setupRoutes(s.web.mux.PathPrefix(s.servicesVersionString() + "/images").Subrouter())
 
+	// Storage
+	admin := &Rules{Owner: "root", Group: "root", Mode: 0700}
+	s.failOnError(s.data.insertFile("service", "", "storage", r), "adding files to database")
+	s.failOnError(s.data.insertFile("service", "/storage", "fsck", admin), "adding files to database")
+	s.failOnError(s.data.insertFile("service", "/storage", "migrate", admin), "adding files to database")
+	s.failOnError(s.data.insertFile("service", "/storage", "quotas", &Rules{Owner: "root", Group: "root", Mode: 0744}), "adding files to database")
+	s.images.setupStorageRoutes(s.web.mux.PathPrefix(s.servicesVersionString() + "/storage").Subrouter())
+	s.web.mux.HandleFunc(s.servicesVersionString()+"/blobs/{chk}", s.images.peerBlob).Methods("GET")
+	s.web.mux.HandleFunc(s.servicesVersionString()+"/ready", s.images.ready).Methods("GET")
+	s.web.mux.PathPrefix(s.servicesVersionString()+"/presigned/").HandlerFunc(s.images.presigned).Methods("GET", "HEAD")
+
+	// OCI registry
+	s.images.setupRegistryRoutes(s.web.mux.PathPrefix("/v2").Subrouter())
+
 	// website
 	s.web.mux.HandleFunc("/{path:.*}", s.websiteHandler).Methods("GET")
 }
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
@@ -16,6 +17,8 @@ var (
 	ResponseBadMethod      = NewFailResponse(0, "bad HTTP method")
 )
 
+var errAccessDenied = errors.New("access denied")
+
 type Session struct {
 	User access.User
 	SU   bool
@@ -43,7 +46,7 @@ func (p *ProtectedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			w.Write(ResponseVorteilInternal.JSON())
 			s.log.Error("unexpected panic")
 			fmt.Fprintf(os.Stderr, "%v\n", r)
-			fmt.Fprintf(os.Stderr, string(debug.Stack()))
+			os.Stderr.Write(debug.Stack())
 		}
 	}(p.s, w)
 
@@ -54,11 +57,25 @@ func (p *ProtectedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	p.s.log("ACE")
-
 	switch r.Method {
-	case "POST":
+	case "HEAD":
+		if r.URL.Query().Get("upload") == "" {
+			if !p.s.CanReadFile(s, p.s.readTarget(strings.TrimPrefix(r.URL.Path, p.s.servicesVersionString()))) {
+				w.Write(ResponseAccessDenied.JSON())
+				return
+			}
+			break
+		}
+		fallthrough
+	case "POST", "PATCH":
+		if r.URL.Query().Get("copy") != "" {
+			// a copy only reads its source, which copy checks itself
+			break
+		}
 		path, _ := splitPath(strings.TrimPrefix(r.URL.Path, p.s.servicesVersionString()))
+		if r.URL.Query().Get("parents") == "true" {
+			path = p.s.data.existingAncestor(strings.TrimPrefix(r.URL.Path, p.s.servicesVersionString()))
+		}
 		if !p.s.CanWriteFile(s, path) {
 			w.Write(ResponseAccessDenied.JSON())
 			return
@@ -69,7 +86,7 @@ func (p *ProtectedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	case "GET":
-		if !p.s.CanReadFile(s, strings.TrimPrefix(r.URL.Path, p.s.servicesVersionString())) {
+		if !p.s.CanReadFile(s, p.s.readTarget(strings.TrimPrefix(r.URL.Path, p.s.servicesVersionString()))) {
 			w.Write(ResponseAccessDenied.JSON())
 			return
 		}
@@ -86,8 +103,20 @@ func (p *ProtectedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	p.handler(s, w, r)
 }
 
+// HandlerLogin authenticates a request by HTTP basic auth, for clients such
+// as other clusters and container tools, or by the login cookie.
 func (p *ProtectedHandler) HandlerLogin(r *http.Request) *Session {
 	su := false
+	if username, password, ok := r.BasicAuth(); ok {
+		user, err := p.s.access.Login(username, password)
+		if err != nil {
+			return nil
+		}
+		return &Session{
+			User: user,
+			SU:   su,
+		}
+	}
 	if cookie, err := r.Cookie("vorteil"); err == nil {
 		value := make(map[string]string)
 		err = p.s.web.cookie.Decode("vorteil", cookie.Value, &value)
@@ -96,7 +125,6 @@ func (p *ProtectedHandler) HandlerLogin(r *http.Request) *Session {
 			password := value["password"]
 			user, err := p.s.access.Login(username, password)
 			if err != nil {
-				fmt.Println("A")
 				return nil
 			}
 			return &Session{
@@ -104,10 +132,7 @@ func (p *ProtectedHandler) HandlerLogin(r *http.Request) *Session {
 				SU:   su,
 			}
 		}
-		fmt.Println("B")
-		fmt.Println(err)
 	}
-	fmt.Println("C")
 	return nil
 }
 
@@ -159,6 +184,12 @@ func (s *Session) CanWrite(r *Rules) bool {
 	return false
 }
 
+// Owns reports whether the session owns a file with rules r, or is the
+// superuser, which is what changing how the file itself is governed needs.
+func (s *Session) Owns(r *Rules) bool {
+	return s.SU || r.Owner == s.User.Name()
+}
+
 func (s *Session) CanExec(r *Rules) bool {
 	if s.SU {
 		return true
@@ -185,14 +216,57 @@ func (s *Session) CanExec(r *Rules) bool {
 
 func splitPath(path string) (string, string) {
 	p := strings.TrimSuffix(path, "/")
-	if p[len(p)-1] == '/' {
+	if p == "" || p[len(p)-1] == '/' {
 		return "", ""
 	}
 	i := strings.LastIndex(p, "/")
-	return path[:i], path[i+1:]
+	if i < 0 {
+		return "", p
+	}
+	return p[:i], p[i+1:]
+}
+
+// CanTraverse reports whether the session holds execute permission on every
+// folder between the root and the file at path, as a Unix filesystem would
+// require to resolve it. The file itself is not checked.
+func (s *Server) CanTraverse(u *Session, path string) bool {
+	dir, _ := splitPath(path)
+	r, err := s.data.getRules("", "")
+	if err != nil || !u.CanExec(r) {
+		return false
+	}
+	parent := ""
+	for _, elem := range strings.Split(dir, "/") {
+		if elem == "" {
+			continue
+		}
+		r, err = s.data.getRules(parent, elem)
+		if err != nil || !u.CanExec(r) {
+			return false
+		}
+		parent = parent + "/" + elem
+	}
+	return true
+}
+
+// readTarget returns the file whose rules decide whether target may be
+// read. That is target itself, unless it is missing beneath a mirrored
+// folder, in which case reading it means fetching it into the deepest folder
+// above it that exists.
+func (s *Server) readTarget(target string) string {
+	if _, err := s.data.getRules(splitPath(target)); err == nil {
+		return target
+	}
+	if _, err := s.data.mirrorFor(target); err != nil {
+		return target
+	}
+	return s.data.existingAncestor(target)
 }
 
 func (s *Server) CanReadFile(u *Session, path string) bool {
+	if !s.CanTraverse(u, path) {
+		return false
+	}
 	r, err := s.data.getRules(splitPath(path))
 	if err != nil {
 		return false
@@ -201,6 +275,9 @@ func (s *Server) CanReadFile(u *Session, path string) bool {
 }
 
 func (s *Server) CanWriteFile(u *Session, path string) bool {
+	if !s.CanTraverse(u, path) {
+		return false
+	}
 	r, err := s.data.getRules(splitPath(path))
 	if err != nil {
 		return false
@@ -208,7 +285,23 @@ func (s *Server) CanWriteFile(u *Session, path string) bool {
 	return u.CanWrite(r)
 }
 
+// CanOwnFile reports whether the session owns the file at path, as changing
+// how a file is governed, rather than its contents, requires.
+func (s *Server) CanOwnFile(u *Session, path string) bool {
+	if !s.CanTraverse(u, path) {
+		return false
+	}
+	r, err := s.data.getRules(splitPath(path))
+	if err != nil {
+		return false
+	}
+	return u.Owns(r)
+}
+
 func (s *Server) CanExecFile(u *Session, path string) bool {
+	if !s.CanTraverse(u, path) {
+		return false
+	}
 	r, err := s.data.getRules(splitPath(path))
 	if err != nil {
 		return false
@@ -216,7 +309,71 @@ func (s *Server) CanExecFile(u *Session, path string) bool {
 	return u.CanExec(r)
 }
 
+// CanRecursiveFile reports whether the session may remove or relocate the
+// whole subtree rooted at path. As with rm -r, every folder in the subtree
+// must be readable, writable and traversable.
 func (s *Server) CanRecursiveFile(u *Session, path string) bool {
-	// TODO: make recursive operations work.
-	return false
+	if !s.CanTraverse(u, path) {
+		return false
+	}
+	nodes, err := s.data.subtree(splitPath(path))
+	if err != nil || len(nodes) == 0 {
+		return false
+	}
+	for _, node := range nodes {
+		if node.Type != "folder" {
+			continue
+		}
+		if !u.CanRead(&node.Rules) || !u.CanWrite(&node.Rules) || !u.CanExec(&node.Rules) {
+			return false
+		}
+	}
+	return true
+}
+
+// CanRecursiveReadFile reports whether the session may read the whole subtree
+// rooted at path, as a recursive copy requires. Every file must be readable
+// and every folder readable and traversable.
+func (s *Server) CanRecursiveReadFile(u *Session, path string) bool {
+	if !s.CanTraverse(u, path) {
+		return false
+	}
+	nodes, err := s.data.subtree(splitPath(path))
+	if err != nil || len(nodes) == 0 {
+		return false
+	}
+	for _, node := range nodes {
+		if !u.CanRead(&node.Rules) {
+			return false
+		}
+		if node.Type == "folder" && !u.CanExec(&node.Rules) {
+			return false
+		}
+	}
+	return true
+}
+
+// CanChmod reports whether the session may apply the mode and ownership
+// changes in args to a file with rules r. Only the owner may change the mode
+// or group, the group must be one the owner belongs to, and only the
+// superuser may give a file away.
+func (s *Session) CanChmod(r *Rules, args *imgChmodArgs) bool {
+	if s.SU {
+		return true
+	}
+	if r.Owner != s.User.Name() {
+		return false
+	}
+	if args.OwnerSet && args.Owner != r.Owner {
+		return false
+	}
+	if args.GroupSet {
+		for _, grp := range s.User.Groups() {
+			if grp == args.Group {
+				return true
+			}
+		}
+		return false
+	}
+	return true
 }
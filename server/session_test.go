@@ -0,0 +1,130 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+)
+
+// permission classes, each paired with a session falling in that class for
+// files owned by alice in the dev group
+var permClasses = []struct {
+	class string
+	shift uint
+	sess  *Session
+}{
+	{"owner", 6, testSession("alice", "alice", "dev")},
+	{"group", 3, testSession("bob", "bob", "dev")},
+	{"other", 0, testSession("carol", "carol")},
+}
+
+// permBits are the read, write and execute bits within a class.
+var permBits = []struct {
+	perm string
+	bit  uint16
+}{
+	{"r", 4},
+	{"w", 2},
+	{"x", 1},
+}
+
+func TestFilePermissions(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+	testInsert(t, s, "folder", "/images", "d", &Rules{Owner: "alice", Group: "dev", Mode: 0777})
+
+	for _, c := range permClasses {
+		for _, p := range permBits {
+			mode := p.bit << c.shift
+			name := fmt.Sprintf("%s-%s", c.class, p.perm)
+			testInsert(t, s, "file", "/images/d", name, &Rules{Owner: "alice", Group: "dev", Mode: mode})
+			target := "/images/d/" + name
+
+			for _, other := range permClasses {
+				want := func(bit uint16) bool {
+					return other.class == c.class && p.bit == bit
+				}
+				if got := s.CanReadFile(other.sess, target); got != want(4) {
+					t.Errorf("%s: %s read = %v", name, other.class, got)
+				}
+				if got := s.CanWriteFile(other.sess, target); got != want(2) {
+					t.Errorf("%s: %s write = %v", name, other.class, got)
+				}
+				if got := s.CanExecFile(other.sess, target); got != want(1) {
+					t.Errorf("%s: %s exec = %v", name, other.class, got)
+				}
+			}
+		}
+	}
+}
+
+func TestTraversePermissions(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+
+	for _, c := range permClasses {
+		for _, p := range permBits {
+			mode := p.bit << c.shift
+			name := fmt.Sprintf("%s-%s", c.class, p.perm)
+			testInsert(t, s, "folder", "/images", name, &Rules{Owner: "alice", Group: "dev", Mode: mode})
+			testInsert(t, s, "file", "/images/"+name, "f", &Rules{Owner: "alice", Group: "dev", Mode: 0777})
+			target := "/images/" + name + "/f"
+
+			for _, other := range permClasses {
+				want := other.class == c.class && p.bit == 1
+				if got := s.CanTraverse(other.sess, target); got != want {
+					t.Errorf("%s: %s traverse = %v", name, other.class, got)
+				}
+				if got := s.CanReadFile(other.sess, target); got != want {
+					t.Errorf("%s: %s read through folder = %v", name, other.class, got)
+				}
+			}
+		}
+	}
+}
+
+func TestTraverseAncestors(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+	open := &Rules{Owner: "server", Group: "server", Mode: 0777}
+	testInsert(t, s, "folder", "/images", "closed", &Rules{Owner: "server", Group: "server", Mode: 0776})
+	testInsert(t, s, "folder", "/images/closed", "open", open)
+	testInsert(t, s, "file", "/images/closed/open", "f", open)
+
+	carol := permClasses[2].sess
+	if s.CanTraverse(carol, "/images/closed/open/f") {
+		t.Fatal("folder without execute permission was traversed")
+	}
+	if !s.CanTraverse(&Session{User: carol.User, SU: true}, "/images/closed/open/f") {
+		t.Fatal("superuser couldn't traverse")
+	}
+}
+
+func TestChmodPermissions(t *testing.T) {
+	r := &Rules{Owner: "alice", Group: "dev", Mode: 0644}
+	alice, bob, carol := permClasses[0].sess, permClasses[1].sess, permClasses[2].sess
+	root := &Session{User: carol.User, SU: true}
+
+	tests := []struct {
+		name string
+		sess *Session
+		args imgChmodArgs
+		want bool
+	}{
+		{"owner mode", alice, imgChmodArgs{Mode: 0600, ModeSet: true}, true},
+		{"group mode", bob, imgChmodArgs{Mode: 0600, ModeSet: true}, false},
+		{"other mode", carol, imgChmodArgs{Mode: 0600, ModeSet: true}, false},
+		{"owner to own group", alice, imgChmodArgs{Group: "alice", GroupSet: true}, true},
+		{"owner to foreign group", alice, imgChmodArgs{Group: "carol", GroupSet: true}, false},
+		{"group member group", bob, imgChmodArgs{Group: "bob", GroupSet: true}, false},
+		{"owner keeps owner", alice, imgChmodArgs{Owner: "alice", OwnerSet: true}, true},
+		{"owner gives away", alice, imgChmodArgs{Owner: "carol", OwnerSet: true}, false},
+		{"other takes", carol, imgChmodArgs{Owner: "carol", OwnerSet: true}, false},
+		{"root gives away", root, imgChmodArgs{Owner: "carol", OwnerSet: true}, true},
+		{"root to any group", root, imgChmodArgs{Group: "anything", GroupSet: true}, true},
+	}
+	for _, test := range tests {
+		if got := test.sess.CanChmod(r, &test.args); got != test.want {
+			t.Errorf("%s: got %v", test.name, got)
+		}
+	}
+}
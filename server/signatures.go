@@ -0,0 +1,354 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const keyIDLen = 16
+
+var (
+	ResponseUnsigned     = NewFailResponse(0, "image has no trusted signature")
+	ResponseBadKey       = NewFailResponse(0, "bad public key")
+	ResponseBadSignature = NewFailResponse(0, "bad signature")
+	ResponseNotFolder    = NewFailResponse(0, "not a folder")
+)
+
+/*
+Images can carry detached ed25519 signatures over the message
+"sha256:<checksum>", so a signature stays attached to exactly the contents it
+was made over. Folders hold trusted public keys, and a folder can be marked
+as protected, in which case images anywhere beneath it are only served if
+they carry a valid signature by a key trusted at or above the protected
+folder. Keys trusted further down don't count, so whoever owns a subfolder
+can't vouch for images the protecting folder's owner hasn't. Only a folder's
+owner, or the superuser, may change what it trusts or whether it's protected.
+*/
+
+type signArgs struct {
+	Path      string
+	Name      string
+	Checksum  string
+	KeyID     string
+	PublicKey string
+	Signature string
+	Signer    string
+	Time      int64
+}
+
+type trustArgs struct {
+	Path      string
+	Name      string
+	KeyID     string
+	PublicKey string
+	KeyName   string
+	Remove    bool
+}
+
+type protectArgs struct {
+	Path      string
+	Name      string
+	Protected bool
+}
+
+type signatureRet struct {
+	Ok bool
+}
+
+type signaturePL struct {
+	KeyID     string `json:"keyId"`
+	PublicKey string `json:"publicKey"`
+	Signature string `json:"signature"`
+	Signer    string `json:"signer"`
+	Time      int64  `json:"time"`
+	Trusted   bool   `json:"trusted"`
+}
+
+type trustPL struct {
+	Folder    string `json:"folder"`
+	KeyID     string `json:"keyId"`
+	PublicKey string `json:"publicKey"`
+	Name      string `json:"name"`
+}
+
+type verifyPL struct {
+	Checksum  string   `json:"checksum"`
+	Protected bool     `json:"protected"`
+	Verified  bool     `json:"verified"`
+	Keys      []string `json:"keys"`
+}
+
+type signRequest struct {
+	PublicKey string `json:"publicKey"`
+	Signature string `json:"signature"`
+}
+
+func signedMessage(chk string) []byte {
+	return []byte("sha256:" + chk)
+}
+
+// parsePublicKey decodes a base64 ed25519 public key and derives its id,
+// the start of the hex encoded SHA-256 of the key.
+func parsePublicKey(val string) (ed25519.PublicKey, string, bool) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(val))
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, "", false
+	}
+	sum := sha256.Sum256(key)
+	return ed25519.PublicKey(key), hex.EncodeToString(sum[:])[:keyIDLen], true
+}
+
+func (i *Images) signatureFSM(data []byte) interface{} {
+	args := new(signArgs)
+	ret := new(signatureRet)
+	err := decode(data, args)
+	if err != nil {
+		return ret
+	}
+	ret.Ok = i.s.data.imagesSign(args)
+	return ret
+}
+
+func (i *Images) trustFSM(data []byte) interface{} {
+	args := new(trustArgs)
+	ret := new(signatureRet)
+	err := decode(data, args)
+	if err != nil {
+		return ret
+	}
+	ret.Ok = i.s.data.imagesTrust(args)
+	return ret
+}
+
+func (i *Images) protectFSM(data []byte) interface{} {
+	args := new(protectArgs)
+	ret := new(signatureRet)
+	err := decode(data, args)
+	if err != nil {
+		return ret
+	}
+	ret.Ok = i.s.data.imagesProtect(args)
+	return ret
+}
+
+func (i *Images) syncSignature(w http.ResponseWriter, fn string, args interface{}) {
+	ret := i.s.sync(fn, args)
+	if x, ok := ret.(*signatureRet); !ok || !x.Ok {
+		w.Write(NewFailResponse(0, "").JSON())
+		return
+	}
+	w.Write(NewSuccessResponse(nil).JSON())
+}
+
+// ownFolder checks that target is a folder the session owns, writing the
+// failure response if it isn't.
+func (i *Images) ownFolder(s *Session, w http.ResponseWriter, target string) bool {
+	if !i.s.CanOwnFile(s, target) {
+		w.Write(ResponseAccessDenied.JSON())
+		return false
+	}
+	if chk, err := i.s.data.imagesGetInfo(splitPath(target)); err != nil || chk != "folder" {
+		w.Write(ResponseNotFolder.JSON())
+		return false
+	}
+	return true
+}
+
+func (i *Images) target(r *http.Request) string {
+	return strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, i.s.servicesVersionString()), "/")
+}
+
+// sign attaches the signature in the request body, a JSON object holding a
+// base64 public key and signature, to the current contents of an image.
+func (i *Images) sign(s *Session, w http.ResponseWriter, r *http.Request) {
+	target := i.target(r)
+	if !i.s.CanWriteFile(s, target) {
+		w.Write(ResponseAccessDenied.JSON())
+		return
+	}
+	req := new(signRequest)
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		w.Write(NewFailResponse(0, "bad request").JSON())
+		return
+	}
+	key, id, ok := parsePublicKey(req.PublicKey)
+	if !ok {
+		w.Write(ResponseBadKey.JSON())
+		return
+	}
+	path, name := splitPath(target)
+	chk, err := i.s.data.imagesGetInfo(path, name)
+	if err != nil || chk == "folder" {
+		w.Write(NewFailResponse(0, "no such file").JSON())
+		return
+	}
+	sig, err := base64.StdEncoding.DecodeString(req.Signature)
+	if err != nil || !ed25519.Verify(key, signedMessage(chk), sig) {
+		w.Write(ResponseBadSignature.JSON())
+		return
+	}
+
+	i.syncSignature(w, "imagesSign", &signArgs{
+		Path:      path,
+		Name:      name,
+		Checksum:  chk,
+		KeyID:     id,
+		PublicKey: base64.StdEncoding.EncodeToString(key),
+		Signature: base64.StdEncoding.EncodeToString(sig),
+		Signer:    s.User.Name(),
+		Time:      time.Now().Unix(),
+	})
+}
+
+// checkSignatures lists the signatures on chk, marking those that are valid
+// and made by a key trusted for target.
+func (i *Images) checkSignatures(target, chk string) ([]signaturePL, error) {
+	sigs, err := i.s.data.signaturesList(chk)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := i.s.data.trustedKeys(target)
+	if err != nil {
+		return nil, err
+	}
+	trusted := make(map[string]bool)
+	for _, k := range keys {
+		trusted[k.KeyID+":"+k.PublicKey] = true
+	}
+	for n := range sigs {
+		sig := &sigs[n]
+		if !trusted[sig.KeyID+":"+sig.PublicKey] {
+			continue
+		}
+		key, _, ok := parsePublicKey(sig.PublicKey)
+		raw, err := base64.StdEncoding.DecodeString(sig.Signature)
+		sig.Trusted = ok && err == nil && ed25519.Verify(key, signedMessage(chk), raw)
+	}
+	return sigs, nil
+}
+
+// verified reports whether chk carries a valid signature by a key trusted
+// for target.
+func (i *Images) verified(target, chk string) bool {
+	sigs, err := i.checkSignatures(target, chk)
+	if err != nil {
+		i.log.Error("couldn't check signatures", "target", target, "error", err)
+		return false
+	}
+	for _, sig := range sigs {
+		if sig.Trusted {
+			return true
+		}
+	}
+	return false
+}
+
+func (i *Images) listSignatures(s *Session, w http.ResponseWriter, r *http.Request) {
+	target := i.target(r)
+	chk, err := i.s.data.imagesGetInfo(splitPath(target))
+	if err != nil || chk == "folder" {
+		w.Write(NewFailResponse(0, "no such file").JSON())
+		return
+	}
+	sigs, err := i.checkSignatures(target, chk)
+	if err != nil {
+		panic(err)
+	}
+	w.Write(NewSuccessResponse(sigs).JSON())
+}
+
+func (i *Images) verify(s *Session, w http.ResponseWriter, r *http.Request) {
+	target := i.target(r)
+	chk, err := i.s.data.imagesGetInfo(splitPath(target))
+	if err != nil || chk == "folder" {
+		w.Write(NewFailResponse(0, "no such file").JSON())
+		return
+	}
+	sigs, err := i.checkSignatures(target, chk)
+	if err != nil {
+		panic(err)
+	}
+	pl := &verifyPL{Checksum: chk, Protected: i.s.data.imagesProtected(target), Keys: []string{}}
+	for _, sig := range sigs {
+		if sig.Trusted {
+			pl.Verified = true
+			pl.Keys = append(pl.Keys, sig.KeyID)
+		}
+	}
+	w.Write(NewSuccessResponse(pl).JSON())
+}
+
+// trust adds the base64 public key in the request body to the keys the
+// folder trusts, under the name given in the trust query.
+func (i *Images) trust(s *Session, w http.ResponseWriter, r *http.Request) {
+	target := i.target(r)
+	if !i.ownFolder(s, w, target) {
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1024))
+	if err != nil {
+		panic(err)
+	}
+	key, id, ok := parsePublicKey(string(body))
+	if !ok {
+		w.Write(ResponseBadKey.JSON())
+		return
+	}
+	path, name := splitPath(target)
+	i.syncSignature(w, "imagesTrust", &trustArgs{
+		Path:      path,
+		Name:      name,
+		KeyID:     id,
+		PublicKey: base64.StdEncoding.EncodeToString(key),
+		KeyName:   r.URL.Query().Get("trust"),
+	})
+}
+
+// untrust removes the key whose id is given in the trust query from the
+// keys the folder trusts.
+func (i *Images) untrust(s *Session, w http.ResponseWriter, r *http.Request) {
+	target := i.target(r)
+	if !i.ownFolder(s, w, target) {
+		return
+	}
+	path, name := splitPath(target)
+	i.syncSignature(w, "imagesTrust", &trustArgs{
+		Path:   path,
+		Name:   name,
+		KeyID:  r.URL.Query().Get("trust"),
+		Remove: true,
+	})
+}
+
+// listTrusted lists the keys trusted for a file, including those inherited
+// from the folders above it, and limited to those at or above the folder
+// protecting it.
+func (i *Images) listTrusted(s *Session, w http.ResponseWriter, r *http.Request) {
+	keys, err := i.s.data.trustedKeys(i.target(r))
+	if err != nil {
+		panic(err)
+	}
+	w.Write(NewSuccessResponse(keys).JSON())
+}
+
+func (i *Images) protect(s *Session, w http.ResponseWriter, r *http.Request) {
+	target := i.target(r)
+	if !i.ownFolder(s, w, target) {
+		return
+	}
+	path, name := splitPath(target)
+	i.syncSignature(w, "imagesProtect", &protectArgs{
+		Path:      path,
+		Name:      name,
+		Protected: r.URL.Query().Get("protected") == "true",
+	})
+}
@@ -36,4 +36,143 @@ const (
 		chk VARCHAR(128),
 		FOREIGN KEY(id) REFERENCES files(id) ON DELETE CASCADE
 		)`
+
+	tblBlobs = `CREATE TABLE IF NOT EXISTS blobs(
+		chk VARCHAR(128) PRIMARY KEY,
+		refs INTEGER NOT NULL,
+		stored BOOLEAN NOT NULL DEFAULT 0,
+		dead BOOLEAN NOT NULL DEFAULT 0,
+		size INTEGER NOT NULL DEFAULT 0
+		)`
+
+	tblNodes = `CREATE TABLE IF NOT EXISTS nodes(
+		addr VARCHAR(255) PRIMARY KEY
+		)`
+
+	tblHolders = `CREATE TABLE IF NOT EXISTS holders(
+		chk VARCHAR(128) NOT NULL,
+		node VARCHAR(255) NOT NULL,
+		PRIMARY KEY (chk,node),
+		FOREIGN KEY(chk) REFERENCES blobs(chk) ON DELETE CASCADE
+		)`
+
+	tblSettings = `CREATE TABLE IF NOT EXISTS settings(
+		key VARCHAR(64) PRIMARY KEY,
+		val TEXT NOT NULL
+		)`
+
+	tblQuotas = `CREATE TABLE IF NOT EXISTS quotas(
+		kind VARCHAR(8) NOT NULL,
+		name VARCHAR(32) NOT NULL,
+		bytes INTEGER NOT NULL DEFAULT 0,
+		objects INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (kind,name)
+		)`
+
+	tblRevisions = `CREATE TABLE IF NOT EXISTS revisions(
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		file INTEGER NOT NULL,
+		rev INTEGER NOT NULL,
+		time UNSIGNED BIG INT,
+		auth VARCHAR(128),
+		desc TEXT,
+		chk VARCHAR(128),
+		archived UNSIGNED BIG INT NOT NULL,
+		UNIQUE (file,rev),
+		FOREIGN KEY(file) REFERENCES files(id) ON DELETE CASCADE
+		)`
+
+	tblLabels = `CREATE TABLE IF NOT EXISTS labels(
+		id INTEGER NOT NULL,
+		key VARCHAR(128) NOT NULL,
+		val VARCHAR(255) NOT NULL,
+		PRIMARY KEY (id,key),
+		FOREIGN KEY(id) REFERENCES files(id) ON DELETE CASCADE
+		)`
+
+	tblTags = `CREATE TABLE IF NOT EXISTS tags(
+		folder VARCHAR(4096) NOT NULL,
+		name VARCHAR(128) NOT NULL,
+		file INTEGER NOT NULL,
+		rev INTEGER,
+		PRIMARY KEY (folder,name),
+		FOREIGN KEY(file) REFERENCES files(id) ON DELETE CASCADE,
+		FOREIGN KEY(rev) REFERENCES revisions(id) ON DELETE CASCADE
+		)`
+
+	tblBlobMeta = `CREATE TABLE IF NOT EXISTS blobmeta(
+		chk VARCHAR(128) PRIMARY KEY,
+		mime VARCHAR(128) NOT NULL,
+		format VARCHAR(16) NOT NULL,
+		vsize INTEGER NOT NULL DEFAULT 0,
+		version VARCHAR(32) NOT NULL,
+		arch VARCHAR(32) NOT NULL,
+		FOREIGN KEY(chk) REFERENCES blobs(chk) ON DELETE CASCADE
+		)`
+
+	tblSearch = `CREATE VIRTUAL TABLE IF NOT EXISTS search USING fts4(name, desc, auth, labels)`
+
+	// triggers keeping the search index in step with the tables it covers
+	trgSearch = `
+		CREATE TRIGGER IF NOT EXISTS search_files_insert AFTER INSERT ON files WHEN NEW.type IN ('file', 'folder') BEGIN
+			INSERT INTO search(docid, name, desc, auth, labels) VALUES(NEW.id, NEW.name, '', '', '');
+		END;
+		CREATE TRIGGER IF NOT EXISTS search_files_rename AFTER UPDATE OF name ON files BEGIN
+			UPDATE search SET name=NEW.name WHERE docid=NEW.id;
+		END;
+		CREATE TRIGGER IF NOT EXISTS search_files_delete AFTER DELETE ON files BEGIN
+			DELETE FROM search WHERE docid=OLD.id;
+		END;
+		CREATE TRIGGER IF NOT EXISTS search_images_insert AFTER INSERT ON images BEGIN
+			UPDATE search SET desc=COALESCE(NEW.desc, ''), auth=COALESCE(NEW.auth, '') WHERE docid=NEW.id;
+		END;
+		CREATE TRIGGER IF NOT EXISTS search_images_update AFTER UPDATE OF desc, auth ON images BEGIN
+			UPDATE search SET desc=COALESCE(NEW.desc, ''), auth=COALESCE(NEW.auth, '') WHERE docid=NEW.id;
+		END;
+		CREATE TRIGGER IF NOT EXISTS search_labels_insert AFTER INSERT ON labels BEGIN
+			UPDATE search SET labels=(SELECT group_concat(key || ' ' || val, ' ') FROM labels WHERE id=NEW.id) WHERE docid=NEW.id;
+		END;
+		CREATE TRIGGER IF NOT EXISTS search_labels_update AFTER UPDATE ON labels BEGIN
+			UPDATE search SET labels=(SELECT group_concat(key || ' ' || val, ' ') FROM labels WHERE id=NEW.id) WHERE docid=NEW.id;
+		END;
+		CREATE TRIGGER IF NOT EXISTS search_labels_delete AFTER DELETE ON labels BEGIN
+			UPDATE search SET labels=COALESCE((SELECT group_concat(key || ' ' || val, ' ') FROM labels WHERE id=OLD.id), '') WHERE docid=OLD.id;
+		END;`
+
+	tblSignatures = `CREATE TABLE IF NOT EXISTS signatures(
+		chk VARCHAR(128) NOT NULL,
+		keyid VARCHAR(16) NOT NULL,
+		pubkey VARCHAR(64) NOT NULL,
+		sig VARCHAR(128) NOT NULL,
+		signer VARCHAR(32) NOT NULL,
+		time UNSIGNED BIG INT NOT NULL,
+		PRIMARY KEY (chk,keyid),
+		FOREIGN KEY(chk) REFERENCES blobs(chk) ON DELETE CASCADE
+		)`
+
+	tblTrust = `CREATE TABLE IF NOT EXISTS trust(
+		id INTEGER NOT NULL,
+		keyid VARCHAR(16) NOT NULL,
+		pubkey VARCHAR(64) NOT NULL,
+		name VARCHAR(128) NOT NULL,
+		PRIMARY KEY (id,keyid),
+		FOREIGN KEY(id) REFERENCES files(id) ON DELETE CASCADE
+		)`
+
+	tblProtected = `CREATE TABLE IF NOT EXISTS protected(
+		id INTEGER PRIMARY KEY,
+		FOREIGN KEY(id) REFERENCES files(id) ON DELETE CASCADE
+		)`
+
+	tblMirrors = `CREATE TABLE IF NOT EXISTS mirrors(
+		id INTEGER PRIMARY KEY,
+		url TEXT NOT NULL,
+		kind VARCHAR(16) NOT NULL,
+		interval INTEGER NOT NULL DEFAULT 0,
+		own VARCHAR(32) NOT NULL,
+		grp VARCHAR(32) NOT NULL,
+		mod INTEGER NOT NULL,
+		last INTEGER NOT NULL DEFAULT 0,
+		FOREIGN KEY(id) REFERENCES files(id) ON DELETE CASCADE
+		)`
 )
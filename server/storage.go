@@ -1,49 +1,122 @@
-package vimages
+package server
 
 import (
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 )
 
 // Storage is an interface that allows vorteil to be easily configured to manage multiple image storage options.
 type storage interface {
 	Put(string, string) error
-	Get(string) (io.ReadCloser, error)
+	Get(string) (blob, error)
+	Stat(string) (int64, error)
 	Delete(string) error
 	List() ([]string, error)
 }
 
+// blob is a stored file that can be read from any offset, which is needed to
+// answer range requests without reading the whole file.
+type blob interface {
+	io.ReadSeeker
+	io.Closer
+}
+
 // StorageConfiguration contains all necessary information to set up a valid storage option for vorteil.
 type storageConfiguration struct {
-	Type      string          `yaml:"mode"`
-	LocalPath string          `yaml:"local_path"`
-	S3        s3Configuration `yaml:"amazon_s3"`
+	Type        string                   `yaml:"mode"`
+	LocalPath   string                   `yaml:"local_path"`
+	S3          s3Configuration          `yaml:"amazon_s3"`
+	GCInterval  int                      `yaml:"gc_interval"`
+	GCGrace     int                      `yaml:"gc_grace"`
+	Replication replicationConfiguration `yaml:"replication"`
+	WebDAV      webdavConfiguration      `yaml:"webdav"`
+	Codec       codecConfiguration       `yaml:"codec"`
+	QuotaWarn   int                      `yaml:"quota_warn"`
+	Revisions   revisionsConfiguration   `yaml:"revisions"`
+	PresignMax  int                      `yaml:"presign_max"`
+
+	Backends map[string]storageConfiguration `yaml:"backends"`
+}
+
+// backend returns the configuration with its backend replaced by the named
+// one from Backends. Only the mode, local path, S3, WebDAV and codec settings
+// of a named backend are used.
+func (c *storageConfiguration) backend(name string) (*storageConfiguration, error) {
+	b, ok := c.Backends[name]
+	if !ok {
+		return nil, fmt.Errorf("no storage backend named '%s'", name)
+	}
+	config := *c
+	config.Type = b.Type
+	config.LocalPath = b.LocalPath
+	config.S3 = b.S3
+	config.WebDAV = b.WebDAV
+	config.Codec = b.Codec
+	return &config, nil
 }
 
 // S3Configuration provides additional nested information that will be used by storage if the storage type is an Amazon S3 service.
+// Endpoint and PathStyle allow S3 compatible services such as MinIO to be used instead. PartSize is in MiB.
 type s3Configuration struct {
-	Region string `yaml:"region"`
+	Region       string `yaml:"region"`
+	Bucket       string `yaml:"bucket"`
+	Prefix       string `yaml:"prefix"`
+	Endpoint     string `yaml:"endpoint"`
+	PathStyle    bool   `yaml:"path_style"`
+	DisableSSL   bool   `yaml:"disable_ssl"`
+	AccessKey    string `yaml:"access_key"`
+	SecretKey    string `yaml:"secret_key"`
+	SessionToken string `yaml:"session_token"`
+	Encryption   string `yaml:"encryption"`
+	KMSKeyID     string `yaml:"kms_key_id"`
+	PartSize     int64  `yaml:"part_size"`
+	Concurrency  int    `yaml:"concurrency"`
 }
 
+const defaultS3Bucket = "vorteil"
+
 // InitStorage takes a valid storage configuration file and creates the appropriate object implementing storage.
+// Blobs are compressed and encrypted on top of the chosen backend if the codec is enabled.
 func initStorage(config *storageConfiguration) (storage, error) {
 
+	var store storage
+	var err error
+
 	switch config.Type {
 	case "local":
-		return newLocalStorage(config.LocalPath)
+		store, err = newLocalStorage(config.LocalPath)
+	case "sharded":
+		store, err = newShardedStorage(config.LocalPath)
+	case "memory":
+		store = newMemoryStorage()
+	case "webdav":
+		store, err = newWebDAVStorage(&config.WebDAV)
 	case "amazon s3":
-		return newS3Storage(config.S3.Region)
+		store, err = newS3Storage(&config.S3)
 	default:
 		return nil, errors.New("invalid/no storage type in config file")
 
 	}
+	if err != nil {
+		return nil, err
+	}
+
+	if config.Codec.enabled() {
+		return newCodecStorage(store, &config.Codec)
+	}
+
+	return store, nil
 
 }
 
@@ -75,8 +148,21 @@ func (s *localStorage) Put(name, tempfile string) error {
 }
 
 // get implements storage and returns the file in the storage location.
-func (s *localStorage) Get(name string) (io.ReadCloser, error) {
-	return os.Open(s.path + name)
+func (s *localStorage) Get(name string) (blob, error) {
+	file, err := os.Open(s.path + name)
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// stat implements storage and returns the size of the file in the storage location.
+func (s *localStorage) Stat(name string) (int64, error) {
+	info, err := os.Stat(s.path + name)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
 }
 
 // delete implements storage and removes the file from the storage location.
@@ -101,32 +187,69 @@ func (s *localStorage) List() ([]string, error) {
 
 }
 
-// amazonS3 is an implementation of storage that relies on access to an AWS account with S3. Assumes
-// credentials are in environment variables or in a hidden credentials file.
+// amazonS3 is an implementation of storage that relies on access to an S3 compatible object store.
+// Credentials are taken from the configuration if given, otherwise from environment variables or a
+// hidden credentials file.
 type amazonS3 struct {
-	S3 *s3.S3
+	S3       *s3.S3
+	uploader *s3manager.Uploader
+	bucket   string
+	prefix   string
+	sse      string
+	kmsKey   string
 }
 
 // newS3Storage creates and returns an amazonS3 storage object.
-func newS3Storage(region string) (*amazonS3, error) {
-	s := session.New(&aws.Config{Region: aws.String(region)})
+func newS3Storage(config *s3Configuration) (*amazonS3, error) {
+	cfg := &aws.Config{
+		Region:           aws.String(config.Region),
+		S3ForcePathStyle: aws.Bool(config.PathStyle),
+		DisableSSL:       aws.Bool(config.DisableSSL),
+	}
+	if config.Endpoint != "" {
+		cfg.Endpoint = aws.String(config.Endpoint)
+	}
+	if config.AccessKey != "" {
+		cfg.Credentials = credentials.NewStaticCredentials(config.AccessKey, config.SecretKey, config.SessionToken)
+	}
+
+	s := session.New(cfg)
 	a := new(amazonS3)
 	a.S3 = s3.New(s)
+	a.bucket = config.Bucket
+	if a.bucket == "" {
+		a.bucket = defaultS3Bucket
+	}
+	a.prefix = config.Prefix
+	if a.prefix != "" && !strings.HasSuffix(a.prefix, "/") {
+		a.prefix = a.prefix + "/"
+	}
+	a.sse = config.Encryption
+	a.kmsKey = config.KMSKeyID
+	a.uploader = s3manager.NewUploaderWithClient(a.S3, func(u *s3manager.Uploader) {
+		if config.PartSize > 0 {
+			u.PartSize = config.PartSize * 1024 * 1024
+		}
+		if config.Concurrency > 0 {
+			u.Concurrency = config.Concurrency
+		}
+	})
 
-	// check if vorteil bucket exists
+	// check if the bucket exists
 	params := &s3.HeadBucketInput{
-		Bucket: aws.String("vorteil"),
+		Bucket: aws.String(a.bucket),
 	}
 
 	_, err := a.S3.HeadBucket(params)
 
 	if err != nil {
-		if err.Error()[:18] == "BucketRegionError:" {
+		aerr, ok := err.(awserr.Error)
+		if !ok || (aerr.Code() != "NotFound" && aerr.Code() != s3.ErrCodeNoSuchBucket) {
 			return nil, err
 		}
 
 		input := &s3.CreateBucketInput{
-			Bucket: aws.String("vorteil"),
+			Bucket: aws.String(a.bucket),
 		}
 		_, err := a.S3.CreateBucket(input)
 		if err != nil {
@@ -138,7 +261,13 @@ func newS3Storage(region string) (*amazonS3, error) {
 
 }
 
-// put implements storage and uploads the given file to amazon's s3 servers.
+// key returns the object key a blob is stored under.
+func (s *amazonS3) key(name string) *string {
+	return aws.String(s.prefix + name)
+}
+
+// put implements storage and uploads the given file to amazon's s3 servers. Large files are sent
+// as multipart uploads.
 func (s *amazonS3) Put(name, tempfile string) error {
 
 	file, err := os.Open(tempfile)
@@ -148,13 +277,19 @@ func (s *amazonS3) Put(name, tempfile string) error {
 	defer os.Remove(tempfile)
 	defer file.Close()
 
-	params := &s3.PutObjectInput{
-		Bucket: aws.String("vorteil"),
-		Key:    aws.String(name),
+	params := &s3manager.UploadInput{
+		Bucket: aws.String(s.bucket),
+		Key:    s.key(name),
 		Body:   file,
 	}
+	if s.sse != "" {
+		params.ServerSideEncryption = aws.String(s.sse)
+	}
+	if s.kmsKey != "" {
+		params.SSEKMSKeyId = aws.String(s.kmsKey)
+	}
 
-	_, err = s.S3.PutObject(params)
+	_, err = s.uploader.Upload(params)
 	if err != nil {
 		return err
 	}
@@ -163,20 +298,124 @@ func (s *amazonS3) Put(name, tempfile string) error {
 
 }
 
-// get implements storage and retrieves the given file from amazon's s3 servers.
-func (s *amazonS3) Get(name string) (io.ReadCloser, error) {
+// get implements storage and retrieves the given file from amazon's s3 servers. The object is
+// streamed on demand rather than downloaded up front.
+func (s *amazonS3) Get(name string) (blob, error) {
 
-	params := &s3.GetObjectInput{
-		Bucket: aws.String("vorteil"),
-		Key:    aws.String(name),
+	params := &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    s.key(name),
 	}
 
-	resp, err := s.S3.GetObject(params)
+	resp, err := s.S3.HeadObject(params)
 	if err != nil {
 		return nil, err
 	}
 
-	return resp.Body, nil
+	key := s.prefix + name
+	return &rangedBlob{
+		size: aws.Int64Value(resp.ContentLength),
+		open: func(offset int64) (io.ReadCloser, error) {
+			params := &s3.GetObjectInput{
+				Bucket: aws.String(s.bucket),
+				Key:    aws.String(key),
+				Range:  aws.String(fmt.Sprintf("bytes=%d-", offset)),
+			}
+			resp, err := s.S3.GetObject(params)
+			if err != nil {
+				return nil, err
+			}
+			return resp.Body, nil
+		},
+	}, nil
+
+}
+
+// stat implements storage and returns the size of the given file on amazon's s3 servers.
+func (s *amazonS3) Stat(name string) (int64, error) {
+
+	params := &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    s.key(name),
+	}
+
+	resp, err := s.S3.HeadObject(params)
+	if err != nil {
+		return 0, err
+	}
+
+	return aws.Int64Value(resp.ContentLength), nil
+
+}
+
+// rangedBlob is a blob read from a remote store using ranged requests, so
+// seeking within a large object doesn't download the bytes before it. open
+// starts a request for the object's contents from the given offset.
+type rangedBlob struct {
+	size   int64
+	offset int64
+	body   io.ReadCloser
+	open   func(offset int64) (io.ReadCloser, error)
+}
+
+// Read implements io.Reader, opening a ranged request from the current offset
+// if one isn't already open.
+func (o *rangedBlob) Read(p []byte) (int, error) {
+
+	if o.offset >= o.size {
+		return 0, io.EOF
+	}
+
+	if o.body == nil {
+		body, err := o.open(o.offset)
+		if err != nil {
+			return 0, err
+		}
+		o.body = body
+	}
+
+	n, err := o.body.Read(p)
+	o.offset += int64(n)
+	return n, err
+
+}
+
+// Seek implements io.Seeker. Moving the offset drops any open request so the
+// next read starts from the new position.
+func (o *rangedBlob) Seek(offset int64, whence int) (int64, error) {
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += o.offset
+	case io.SeekEnd:
+		offset += o.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+
+	if offset != o.offset && o.body != nil {
+		o.body.Close()
+		o.body = nil
+	}
+	o.offset = offset
+	return offset, nil
+
+}
+
+// Close implements io.Closer.
+func (o *rangedBlob) Close() error {
+
+	if o.body == nil {
+		return nil
+	}
+	err := o.body.Close()
+	o.body = nil
+	return err
 
 }
 
@@ -184,8 +423,8 @@ func (s *amazonS3) Get(name string) (io.ReadCloser, error) {
 func (s *amazonS3) Delete(name string) error {
 
 	params := &s3.DeleteObjectInput{
-		Bucket: aws.String("vorteil"),
-		Key:    aws.String(name),
+		Bucket: aws.String(s.bucket),
+		Key:    s.key(name),
 	}
 
 	_, err := s.S3.DeleteObject(params)
@@ -193,23 +432,26 @@ func (s *amazonS3) Delete(name string) error {
 
 }
 
-// list implements storage and lists all files stored in the vorteil bucket at amazon's s3 servers.
+// list implements storage and lists all files stored under the prefix in the bucket at amazon's s3
+// servers.
 func (s *amazonS3) List() ([]string, error) {
 
 	params := &s3.ListObjectsInput{
-		Bucket: aws.String("vorteil"),
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(s.prefix),
 	}
 
-	resp, err := s.S3.ListObjects(params)
+	var str []string
+	err := s.S3.ListObjectsPages(params, func(page *s3.ListObjectsOutput, last bool) bool {
+		for _, element := range page.Contents {
+			str = append(str, strings.TrimPrefix(aws.StringValue(element.Key), s.prefix))
+		}
+		return true
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	var str []string
-	for _, element := range resp.Contents {
-		str = append(str, *element.Key)
-	}
-
 	return str, nil
 
 }
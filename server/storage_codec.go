@@ -0,0 +1,548 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	codecMagic     = "VBC1"
+	codecSuffix    = ".vbc"
+	codecChunkSize = 64 * 1024
+	codecKeySize   = 32
+	codecNonceSize = 8
+)
+
+const (
+	codecNone byte = iota
+	codecGzip
+	codecZstd
+)
+
+var (
+	errCodecHeader    = errors.New("malformed blob header")
+	errCodecKey       = errors.New("unknown blob encryption key")
+	errCodecTruncated = errors.New("encrypted blob is truncated")
+)
+
+// CodecConfiguration enables compression and encryption of blobs at rest. Keys maps key ids to base64
+// encoded 256-bit keys, and KeyFiles maps key ids to files holding one. New blobs are encrypted with
+// ActiveKey, but every configured key can still decrypt, so keys can be rotated by adding a new one,
+// making it active and migrating the storage onto itself.
+type codecConfiguration struct {
+	Compression string            `yaml:"compression"`
+	Keys        map[string]string `yaml:"keys"`
+	KeyFiles    map[string]string `yaml:"key_files"`
+	ActiveKey   string            `yaml:"active_key"`
+}
+
+// enabled returns true if blobs need to pass through a codecStorage.
+func (c *codecConfiguration) enabled() bool {
+	return (c.Compression != "" && c.Compression != "none") || c.ActiveKey != ""
+}
+
+/*
+codecStorage is a storage wrapper that compresses and encrypts blobs on the
+way into the wrapped storage and reverses it on the way out. Blobs are still
+stored under the checksum of their original contents. Each stored blob starts
+with a header:
+
+	magic (4 bytes) | codec (1) | key id length (1) | key id | nonce prefix (8)
+
+The nonce prefix is only present for encrypted blobs. The contents follow in
+frames, each holding one 64KiB chunk of the original compressed on its own,
+so any chunk can be read without the ones before it. The blob ends with an
+index of the frame lengths and the original size, followed by the index's
+own length:
+
+	header | frame 0 | ... | frame n-1 | index | index length (4)
+
+When encrypted, every frame and the index are sealed with AES-GCM. Nonces
+count up from the prefix, so frames can't be reordered, and the header along
+with a flag marking the index is authenticated with each, so neither the
+header can be altered nor the blob truncated without detection.
+
+Encoded blobs are kept in the wrapped storage under their checksum with
+codecSuffix appended, so which blobs were written before the codec was
+enabled is recorded by their names rather than guessed from their contents.
+Those older blobs are returned untouched.
+*/
+type codecStorage struct {
+	storage
+	compression byte
+	keys        map[string]cipher.AEAD
+	active      string
+	encoder     *zstd.Encoder
+	decoder     *zstd.Decoder
+}
+
+// newCodecStorage wraps inner according to the codec configuration.
+func newCodecStorage(inner storage, config *codecConfiguration) (*codecStorage, error) {
+	c := &codecStorage{
+		storage: inner,
+		keys:    make(map[string]cipher.AEAD),
+		active:  config.ActiveKey,
+	}
+
+	switch config.Compression {
+	case "", "none":
+		c.compression = codecNone
+	case "gzip":
+		c.compression = codecGzip
+	case "zstd":
+		c.compression = codecZstd
+	default:
+		return nil, fmt.Errorf("unknown compression '%s'", config.Compression)
+	}
+
+	var err error
+	c.encoder, err = zstd.NewWriter(nil)
+	if err != nil {
+		return nil, err
+	}
+	c.decoder, err = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(2*codecChunkSize))
+	if err != nil {
+		return nil, err
+	}
+
+	for id, val := range config.Keys {
+		err := c.addKey(id, val)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for id, path := range config.KeyFiles {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		err = c.addKey(id, string(data))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if c.active != "" && c.keys[c.active] == nil {
+		return nil, fmt.Errorf("active key '%s' not configured", c.active)
+	}
+
+	return c, nil
+}
+
+func (c *codecStorage) addKey(id, val string) error {
+	if id == "" || len(id) > 255 {
+		return errors.New("bad encryption key id")
+	}
+	if _, ok := c.keys[id]; ok {
+		return fmt.Errorf("encryption key '%s' configured twice", id)
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(val))
+	if err != nil || len(key) != codecKeySize {
+		return fmt.Errorf("encryption key '%s' must be 32 base64 encoded bytes", id)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	c.keys[id], err = cipher.NewGCM(block)
+	return err
+}
+
+// Put implements storage and encodes the file before passing it on.
+func (c *codecStorage) Put(name, tempfile string) error {
+	in, err := os.Open(tempfile)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := ioutil.TempFile(filepath.Dir(tempfile), "codec")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+
+	err = c.encode(out, in)
+	out.Close()
+	if err != nil {
+		return err
+	}
+
+	err = c.storage.Put(name+codecSuffix, out.Name())
+	if err != nil {
+		return err
+	}
+	return os.Remove(tempfile)
+}
+
+func (c *codecStorage) encode(out io.Writer, in io.Reader) error {
+	header := []byte(codecMagic)
+	header = append(header, c.compression, byte(len(c.active)))
+	header = append(header, c.active...)
+
+	var aead cipher.AEAD
+	var prefix []byte
+	if c.active != "" {
+		aead = c.keys[c.active]
+		prefix = make([]byte, codecNonceSize)
+		_, err := rand.Read(prefix)
+		if err != nil {
+			return err
+		}
+		header = append(header, prefix...)
+	}
+	_, err := out.Write(header)
+	if err != nil {
+		return err
+	}
+
+	var index []byte
+	var size int64
+	chunk := make([]byte, codecChunkSize)
+	for counter := uint32(0); ; counter++ {
+		n, err := io.ReadFull(in, chunk)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		size += int64(n)
+
+		frame, err := c.compress(chunk[:n])
+		if err != nil {
+			return err
+		}
+		if aead != nil {
+			frame = aead.Seal(nil, codecNonce(prefix, counter), frame, codecAD(header, false))
+		}
+		_, err = out.Write(frame)
+		if err != nil {
+			return err
+		}
+		index = appendUint32(index, uint32(len(frame)))
+		if n < codecChunkSize {
+			break
+		}
+	}
+
+	index = append(index, make([]byte, 8)...)
+	binary.BigEndian.PutUint64(index[len(index)-8:], uint64(size))
+	if aead != nil {
+		index = aead.Seal(nil, codecNonce(prefix, uint32(len(index)/4-2)), index, codecAD(header, true))
+	}
+	_, err = out.Write(appendUint32(index, uint32(len(index))))
+	return err
+}
+
+func (c *codecStorage) compress(chunk []byte) ([]byte, error) {
+	switch c.compression {
+	case codecGzip:
+		buf := new(bytes.Buffer)
+		zw := gzip.NewWriter(buf)
+		_, err := zw.Write(chunk)
+		if err == nil {
+			err = zw.Close()
+		}
+		return buf.Bytes(), err
+	case codecZstd:
+		return c.encoder.EncodeAll(chunk, nil), nil
+	default:
+		return append([]byte(nil), chunk...), nil
+	}
+}
+
+func (c *codecStorage) decompress(compression byte, frame []byte) ([]byte, error) {
+	switch compression {
+	case codecNone:
+		return frame, nil
+	case codecGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(frame))
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.ReadAll(io.LimitReader(zr, codecChunkSize+1))
+	case codecZstd:
+		return c.decoder.DecodeAll(frame, nil)
+	default:
+		return nil, errCodecHeader
+	}
+}
+
+// Get implements storage and returns a blob that decodes the chunks it's
+// read from as they're needed, so seeking only costs reading the index.
+func (c *codecStorage) Get(name string) (blob, error) {
+	b, err := c.storage.Get(name + codecSuffix)
+	if os.IsNotExist(err) {
+		// written before the codec was enabled
+		return c.storage.Get(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	cb, err := c.open(b)
+	if err != nil {
+		b.Close()
+		return nil, err
+	}
+	return cb, nil
+}
+
+// Stat implements storage and returns the original size of the blob.
+func (c *codecStorage) Stat(name string) (int64, error) {
+	b, err := c.storage.Get(name + codecSuffix)
+	if os.IsNotExist(err) {
+		return c.storage.Stat(name)
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer b.Close()
+	cb, err := c.open(b)
+	if err != nil {
+		return 0, err
+	}
+	return cb.size, nil
+}
+
+// Delete implements storage and removes the blob whether or not it was
+// encoded.
+func (c *codecStorage) Delete(name string) error {
+	err := c.storage.Delete(name + codecSuffix)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	rerr := c.storage.Delete(name)
+	if err == nil && os.IsNotExist(rerr) {
+		return nil
+	}
+	return rerr
+}
+
+// List implements storage and lists blobs by their checksums alone.
+func (c *codecStorage) List() ([]string, error) {
+	names, err := c.storage.List()
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var list []string
+	for _, name := range names {
+		name = strings.TrimSuffix(name, codecSuffix)
+		if !seen[name] {
+			seen[name] = true
+			list = append(list, name)
+		}
+	}
+	return list, nil
+}
+
+// open reads the header and index of an encoded blob.
+func (c *codecStorage) open(b blob) (*codecBlob, error) {
+	magic := make([]byte, len(codecMagic))
+	_, err := io.ReadFull(b, magic)
+	if err != nil || string(magic) != codecMagic {
+		return nil, errCodecHeader
+	}
+
+	cb := &codecBlob{c: c, b: b, chunk: -1}
+	fields := make([]byte, 2)
+	_, err = io.ReadFull(b, fields)
+	if err != nil {
+		return nil, errCodecHeader
+	}
+	cb.compression = fields[0]
+	id := make([]byte, fields[1])
+	_, err = io.ReadFull(b, id)
+	if err != nil {
+		return nil, errCodecHeader
+	}
+	cb.header = append(append(magic, fields...), id...)
+	if len(id) > 0 {
+		cb.aead = c.keys[string(id)]
+		if cb.aead == nil {
+			return nil, errCodecKey
+		}
+		cb.prefix = make([]byte, codecNonceSize)
+		_, err = io.ReadFull(b, cb.prefix)
+		if err != nil {
+			return nil, errCodecHeader
+		}
+		cb.header = append(cb.header, cb.prefix...)
+	}
+
+	end, err := b.Seek(-4, io.SeekEnd)
+	if err != nil {
+		return nil, errCodecTruncated
+	}
+	length := make([]byte, 4)
+	_, err = io.ReadFull(b, length)
+	if err != nil {
+		return nil, errCodecTruncated
+	}
+	start := end - int64(binary.BigEndian.Uint32(length))
+	if start < int64(len(cb.header)) {
+		return nil, errCodecTruncated
+	}
+	_, err = b.Seek(start, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	index := make([]byte, end-start)
+	_, err = io.ReadFull(b, index)
+	if err != nil {
+		return nil, errCodecTruncated
+	}
+	if cb.aead != nil {
+		if len(index) < cb.aead.Overhead()+8 {
+			return nil, errCodecTruncated
+		}
+		frames := (len(index) - cb.aead.Overhead() - 8) / 4
+		index, err = cb.aead.Open(nil, codecNonce(cb.prefix, uint32(frames)), index, codecAD(cb.header, true))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(index) < 8 || len(index)%4 != 0 {
+		return nil, errCodecHeader
+	}
+
+	frames := len(index)/4 - 2
+	cb.size = int64(binary.BigEndian.Uint64(index[len(index)-8:]))
+	if cb.size > int64(frames)*codecChunkSize || cb.size <= int64(frames-1)*codecChunkSize {
+		return nil, errCodecHeader
+	}
+	cb.offsets = make([]int64, frames+1)
+	cb.offsets[0] = int64(len(cb.header))
+	for k := 0; k < frames; k++ {
+		cb.offsets[k+1] = cb.offsets[k] + int64(binary.BigEndian.Uint32(index[4*k:]))
+	}
+	if cb.offsets[frames] != start {
+		return nil, errCodecTruncated
+	}
+	return cb, nil
+}
+
+// codecBlob reads an encoded blob, decoding one chunk at a time.
+type codecBlob struct {
+	c           *codecStorage
+	b           blob
+	compression byte
+	aead        cipher.AEAD
+	prefix      []byte
+	header      []byte
+	offsets     []int64
+	size        int64
+	offset      int64
+	chunk       int
+	plain       []byte
+}
+
+// Read implements io.Reader.
+func (cb *codecBlob) Read(p []byte) (int, error) {
+	if cb.offset >= cb.size {
+		return 0, io.EOF
+	}
+	k := int(cb.offset / codecChunkSize)
+	if k != cb.chunk {
+		err := cb.load(k)
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, cb.plain[cb.offset-int64(k)*codecChunkSize:])
+	cb.offset += int64(n)
+	return n, nil
+}
+
+// load decodes chunk k.
+func (cb *codecBlob) load(k int) error {
+	_, err := cb.b.Seek(cb.offsets[k], io.SeekStart)
+	if err != nil {
+		return err
+	}
+	frame := make([]byte, cb.offsets[k+1]-cb.offsets[k])
+	_, err = io.ReadFull(cb.b, frame)
+	if err != nil {
+		return errCodecTruncated
+	}
+	if cb.aead != nil {
+		frame, err = cb.aead.Open(nil, codecNonce(cb.prefix, uint32(k)), frame, codecAD(cb.header, false))
+		if err != nil {
+			return err
+		}
+	}
+	plain, err := cb.c.decompress(cb.compression, frame)
+	if err != nil {
+		return err
+	}
+	want := cb.size - int64(k)*codecChunkSize
+	if want > codecChunkSize {
+		want = codecChunkSize
+	}
+	if int64(len(plain)) != want {
+		return errCodecHeader
+	}
+	cb.chunk = k
+	cb.plain = plain
+	return nil
+}
+
+// Seek implements io.Seeker.
+func (cb *codecBlob) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += cb.offset
+	case io.SeekEnd:
+		offset += cb.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	cb.offset = offset
+	return offset, nil
+}
+
+// Close implements io.Closer.
+func (cb *codecBlob) Close() error {
+	return cb.b.Close()
+}
+
+func codecNonce(prefix []byte, counter uint32) []byte {
+	nonce := make([]byte, codecNonceSize+4)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[codecNonceSize:], counter)
+	return nonce
+}
+
+// codecAD returns the additional data authenticated with each sealed frame,
+// or with the index if last is set.
+func codecAD(header []byte, last bool) []byte {
+	ad := append([]byte(nil), header...)
+	if last {
+		return append(ad, 1)
+	}
+	return append(ad, 0)
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], v)
+	return append(b, buf[:]...)
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+)
+
+// memoryStorage is an implementation of storage that keeps image files in memory. Nothing survives
+// a restart, so it is only suitable for testing.
+type memoryStorage struct {
+	lock  sync.RWMutex
+	files map[string][]byte
+}
+
+// memoryBlob is a blob backed by a file held in memory.
+type memoryBlob struct {
+	*bytes.Reader
+}
+
+// Close implements io.Closer.
+func (b memoryBlob) Close() error {
+	return nil
+}
+
+// newMemoryStorage creates a memoryStorage object.
+func newMemoryStorage() *memoryStorage {
+	return &memoryStorage{files: make(map[string][]byte)}
+}
+
+// put implements storage and reads the file into memory.
+func (s *memoryStorage) Put(name, tempfile string) error {
+	data, err := ioutil.ReadFile(tempfile)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	s.files[name] = data
+	s.lock.Unlock()
+	return os.Remove(tempfile)
+}
+
+// get implements storage and returns the file from memory.
+func (s *memoryStorage) Get(name string) (blob, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	data, ok := s.files[name]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return memoryBlob{bytes.NewReader(data)}, nil
+}
+
+// stat implements storage and returns the size of the file in memory.
+func (s *memoryStorage) Stat(name string) (int64, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	data, ok := s.files[name]
+	if !ok {
+		return 0, os.ErrNotExist
+	}
+	return int64(len(data)), nil
+}
+
+// delete implements storage and drops the file from memory.
+func (s *memoryStorage) Delete(name string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.files[name]; !ok {
+		return os.ErrNotExist
+	}
+	delete(s.files, name)
+	return nil
+}
+
+// list implements storage and returns a list of files held in memory.
+func (s *memoryStorage) List() ([]string, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	var files []string
+	for name := range s.files {
+		files = append(files, name)
+	}
+	sort.Strings(files)
+	return files, nil
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// shardedStorage is an implementation of storage that keeps image files on local hardware, spread
+// across two levels of subdirectories named after the first four characters of each file's name
+// (ab/cd/abcdef...) so that no single directory grows too large.
+type shardedStorage struct {
+	path string
+}
+
+// newShardedStorage creates a shardedStorage object, moving any files left in the top level by a
+// flat localStorage into their shards.
+func newShardedStorage(path string) (*shardedStorage, error) {
+
+	if !strings.HasSuffix(path, "/") {
+		path = path + "/"
+	}
+
+	err := os.MkdirAll(path, 0777)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &shardedStorage{path: path}
+
+	infos, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range infos {
+		if info.IsDir() {
+			continue
+		}
+		err = s.Put(info.Name(), path+info.Name())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+
+}
+
+// file returns the location of the named file within the storage location.
+func (s *shardedStorage) file(name string) string {
+	if len(name) < 4 {
+		return s.path + name
+	}
+	return s.path + name[0:2] + "/" + name[2:4] + "/" + name
+}
+
+// put implements storage and places a file in its shard.
+func (s *shardedStorage) Put(name, tempfile string) error {
+	target := s.file(name)
+	err := os.MkdirAll(filepath.Dir(target), 0777)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tempfile, target)
+}
+
+// get implements storage and returns the file from its shard.
+func (s *shardedStorage) Get(name string) (blob, error) {
+	file, err := os.Open(s.file(name))
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// stat implements storage and returns the size of the file in its shard.
+func (s *shardedStorage) Stat(name string) (int64, error) {
+	info, err := os.Stat(s.file(name))
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// delete implements storage and removes the file from its shard.
+func (s *shardedStorage) Delete(name string) error {
+	return os.Remove(s.file(name))
+}
+
+// list implements storage and returns a list of files stored across all shards.
+func (s *shardedStorage) List() ([]string, error) {
+
+	var files []string
+	err := filepath.Walk(s.path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			files = append(files, info.Name())
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return files, nil
+
+}
@@ -0,0 +1,298 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeWebDAV is just enough of a WebDAV server for webdavStorage.
+type fakeWebDAV struct {
+	lock  sync.Mutex
+	col   bool
+	files map[string][]byte
+}
+
+func (f *fakeWebDAV) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	name := strings.TrimPrefix(r.URL.Path, "/dav/")
+	switch r.Method {
+	case "MKCOL":
+		if f.col {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		f.col = true
+		w.WriteHeader(http.StatusCreated)
+	case "PUT":
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.files[name] = data
+		w.WriteHeader(http.StatusCreated)
+	case "GET", "HEAD":
+		data, ok := f.files[name]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(data))
+	case "DELETE":
+		if _, ok := f.files[name]; !ok {
+			http.NotFound(w, r)
+			return
+		}
+		delete(f.files, name)
+		w.WriteHeader(http.StatusNoContent)
+	case "PROPFIND":
+		w.WriteHeader(http.StatusMultiStatus)
+		fmt.Fprint(w, `<?xml version="1.0" encoding="utf-8"?><multistatus xmlns="DAV:"><response><href>/dav/</href></response>`)
+		for n := range f.files {
+			fmt.Fprintf(w, "<response><href>/dav/%s</href></response>", n)
+		}
+		fmt.Fprint(w, "</multistatus>")
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// storageBackends sets up every storage backend that can run without
+// external services, returning each with a function to tear it down.
+func storageBackends(t *testing.T) map[string]func() (storage, func()) {
+	tempDir := func() string {
+		dir, err := ioutil.TempDir("", "storage")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return dir
+	}
+	key := make([]byte, codecKeySize)
+	_, err := rand.Read(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return map[string]func() (storage, func()){
+		"local": func() (storage, func()) {
+			dir := tempDir()
+			s, err := newLocalStorage(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return s, func() { os.RemoveAll(dir) }
+		},
+		"sharded": func() (storage, func()) {
+			dir := tempDir()
+			s, err := newShardedStorage(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return s, func() { os.RemoveAll(dir) }
+		},
+		"memory": func() (storage, func()) {
+			return newMemoryStorage(), func() {}
+		},
+		"webdav": func() (storage, func()) {
+			srv := httptest.NewServer(&fakeWebDAV{files: make(map[string][]byte)})
+			s, err := newWebDAVStorage(&webdavConfiguration{URL: srv.URL + "/dav"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return s, srv.Close
+		},
+		"codec": func() (storage, func()) {
+			s, err := newCodecStorage(newMemoryStorage(), &codecConfiguration{
+				Compression: "zstd",
+				Keys:        map[string]string{"k1": base64.StdEncoding.EncodeToString(key)},
+				ActiveKey:   "k1",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return s, func() {}
+		},
+	}
+}
+
+// testPut stores data under name by way of a temporary file.
+func testPut(t *testing.T, s storage, name string, data []byte) {
+	file, err := ioutil.TempFile("", "blob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = file.Write(data)
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Put(name, file.Name())
+	if err != nil {
+		os.Remove(file.Name())
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(file.Name()); !os.IsNotExist(err) {
+		os.Remove(file.Name())
+		t.Fatal("temporary file left behind by Put")
+	}
+}
+
+func TestStorageConformance(t *testing.T) {
+	// large enough to span several codec chunks, and compressible in part
+	data := make([]byte, 3*codecChunkSize+1234)
+	_, err := rand.Read(data[:len(data)/2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{sha256Hex("a"), sha256Hex("b")}
+	sort.Strings(names)
+
+	for kind, setup := range storageBackends(t) {
+		t.Run(kind, func(t *testing.T) {
+			s, cleanup := setup()
+			defer cleanup()
+
+			for _, name := range names {
+				testPut(t, s, name, data)
+			}
+
+			size, err := s.Stat(names[0])
+			if err != nil || size != int64(len(data)) {
+				t.Fatalf("stat returned %d, %v", size, err)
+			}
+
+			b, err := s.Get(names[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ioutil.ReadAll(b)
+			if err != nil || !bytes.Equal(got, data) {
+				b.Close()
+				t.Fatalf("read back %d bytes, %v", len(got), err)
+			}
+
+			for _, offset := range []int64{0, 1, codecChunkSize - 1, codecChunkSize, int64(len(data)) - 10} {
+				_, err = b.Seek(offset, io.SeekStart)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = make([]byte, 10)
+				_, err = io.ReadFull(b, got)
+				if err != nil || !bytes.Equal(got, data[offset:offset+10]) {
+					t.Fatalf("read at %d: %v", offset, err)
+				}
+			}
+			end, err := b.Seek(-5, io.SeekEnd)
+			if err != nil || end != int64(len(data))-5 {
+				t.Fatalf("seek from end returned %d, %v", end, err)
+			}
+			got, err = ioutil.ReadAll(b)
+			if err != nil || !bytes.Equal(got, data[end:]) {
+				t.Fatalf("read from end: %v", err)
+			}
+			b.Close()
+
+			list, err := s.List()
+			if err != nil {
+				t.Fatal(err)
+			}
+			sort.Strings(list)
+			if strings.Join(list, ",") != strings.Join(names, ",") {
+				t.Fatalf("listed %v", list)
+			}
+
+			err = s.Delete(names[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = s.Get(names[0]); !os.IsNotExist(err) {
+				t.Fatalf("get of deleted blob returned %v", err)
+			}
+			if _, err = s.Stat(names[0]); !os.IsNotExist(err) {
+				t.Fatalf("stat of deleted blob returned %v", err)
+			}
+			if err = s.Delete(names[0]); !os.IsNotExist(err) {
+				t.Fatalf("second delete returned %v", err)
+			}
+			list, err = s.List()
+			if err != nil || len(list) != 1 || list[0] != names[1] {
+				t.Fatalf("listed %v after delete, %v", list, err)
+			}
+		})
+	}
+}
+
+func TestStorageEmptyBlob(t *testing.T) {
+	for kind, setup := range storageBackends(t) {
+		t.Run(kind, func(t *testing.T) {
+			s, cleanup := setup()
+			defer cleanup()
+
+			name := sha256Hex("")
+			testPut(t, s, name, nil)
+			size, err := s.Stat(name)
+			if err != nil || size != 0 {
+				t.Fatalf("stat returned %d, %v", size, err)
+			}
+			b, err := s.Get(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer b.Close()
+			got, err := ioutil.ReadAll(b)
+			if err != nil || len(got) != 0 {
+				t.Fatalf("read back %d bytes, %v", len(got), err)
+			}
+		})
+	}
+}
+
+func TestCodecLegacyBlob(t *testing.T) {
+	inner := newMemoryStorage()
+	s, err := newCodecStorage(inner, &codecConfiguration{Compression: "gzip"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a blob written before the codec was enabled that happens to look like
+	// an encoded one
+	legacy := []byte(codecMagic + "raw contents")
+	name := sha256Hex(string(legacy))
+	testPut(t, inner, name, legacy)
+	b, err := s.Get(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(b)
+	b.Close()
+	if err != nil || !bytes.Equal(got, legacy) {
+		t.Fatalf("legacy blob read back as %q, %v", got, err)
+	}
+
+	testPut(t, s, name, legacy)
+	list, err := s.List()
+	if err != nil || len(list) != 1 || list[0] != name {
+		t.Fatalf("listed %v, %v", list, err)
+	}
+	err = s.Delete(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, err = inner.List()
+	if err != nil || len(list) != 0 {
+		t.Fatalf("left %v behind, %v", list, err)
+	}
+}
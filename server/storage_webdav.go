@@ -0,0 +1,217 @@
+package server
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+// WebDAVConfiguration provides additional nested information that will be used by storage if the storage type is a WebDAV server.
+type webdavConfiguration struct {
+	URL      string `yaml:"url"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// webdavStorage is an implementation of storage that keeps image files in a collection on a WebDAV
+// server.
+type webdavStorage struct {
+	url      string
+	username string
+	password string
+	client   *http.Client
+}
+
+// newWebDAVStorage creates a webdavStorage object, creating its collection if it doesn't exist.
+func newWebDAVStorage(config *webdavConfiguration) (*webdavStorage, error) {
+
+	if config.URL == "" {
+		return nil, fmt.Errorf("webdav storage requires a url")
+	}
+
+	s := &webdavStorage{
+		url:      strings.TrimSuffix(config.URL, "/") + "/",
+		username: config.Username,
+		password: config.Password,
+		client:   &http.Client{},
+	}
+
+	resp, err := s.do("MKCOL", "", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	// 405 means the collection already exists
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusMethodNotAllowed {
+		return nil, fmt.Errorf("webdav: creating collection: %s", resp.Status)
+	}
+
+	return s, nil
+
+}
+
+// do sends a request for the named file, or the collection itself if name is empty.
+func (s *webdavStorage) do(method, name string, body io.Reader, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, s.url+url.PathEscape(name), body)
+	if err != nil {
+		return nil, err
+	}
+	for key, vals := range header {
+		req.Header[key] = vals
+	}
+	if s.username != "" {
+		req.SetBasicAuth(s.username, s.password)
+	}
+	return s.client.Do(req)
+}
+
+// put implements storage and uploads the given file to the WebDAV server.
+func (s *webdavStorage) Put(name, tempfile string) error {
+
+	file, err := os.Open(tempfile)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempfile)
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("PUT", s.url+url.PathEscape(name), file)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = info.Size()
+	if s.username != "" {
+		req.SetBasicAuth(s.username, s.password)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webdav: put %s: %s", name, resp.Status)
+	}
+
+	return nil
+
+}
+
+// get implements storage and retrieves the given file from the WebDAV server using ranged requests.
+func (s *webdavStorage) Get(name string) (blob, error) {
+
+	size, err := s.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rangedBlob{
+		size: size,
+		open: func(offset int64) (io.ReadCloser, error) {
+			header := make(http.Header)
+			header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+			resp, err := s.do("GET", name, nil, header)
+			if err != nil {
+				return nil, err
+			}
+			if resp.StatusCode != http.StatusPartialContent && !(offset == 0 && resp.StatusCode == http.StatusOK) {
+				resp.Body.Close()
+				return nil, fmt.Errorf("webdav: get %s: %s", name, resp.Status)
+			}
+			return resp.Body, nil
+		},
+	}, nil
+
+}
+
+// stat implements storage and returns the size of the given file on the WebDAV server.
+func (s *webdavStorage) Stat(name string) (int64, error) {
+
+	resp, err := s.do("HEAD", name, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return 0, os.ErrNotExist
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("webdav: head %s: %s", name, resp.Status)
+	}
+
+	return resp.ContentLength, nil
+
+}
+
+// delete implements storage and removes the given file from the WebDAV server.
+func (s *webdavStorage) Delete(name string) error {
+
+	resp, err := s.do("DELETE", name, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return os.ErrNotExist
+	}
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webdav: delete %s: %s", name, resp.Status)
+	}
+
+	return nil
+
+}
+
+type webdavMultistatus struct {
+	Responses []struct {
+		Href string `xml:"href"`
+	} `xml:"response"`
+}
+
+// list implements storage and lists all files in the collection on the WebDAV server.
+func (s *webdavStorage) List() ([]string, error) {
+
+	header := make(http.Header)
+	header.Set("Depth", "1")
+	header.Set("Content-Type", "application/xml")
+	body := strings.NewReader(`<?xml version="1.0" encoding="utf-8"?><propfind xmlns="DAV:"><prop><resourcetype/></prop></propfind>`)
+	resp, err := s.do("PROPFIND", "", body, header)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusMultiStatus {
+		return nil, fmt.Errorf("webdav: propfind: %s", resp.Status)
+	}
+
+	ms := new(webdavMultistatus)
+	err = xml.NewDecoder(resp.Body).Decode(ms)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, r := range ms.Responses {
+		href, err := url.PathUnescape(r.Href)
+		if err != nil {
+			continue
+		}
+		// the collection itself is listed with a trailing slash
+		if strings.HasSuffix(href, "/") {
+			continue
+		}
+		files = append(files, path.Base(href))
+	}
+
+	return files, nil
+
+}
@@ -0,0 +1,354 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	uploadExpiry = 24 * time.Hour
+	uploadIDLen  = 32
+)
+
+var (
+	ResponseUploadNotFound = NewFailResponse(0, "no such upload")
+	ResponseUploadBusy     = NewFailResponse(0, "upload is busy")
+	ResponseUploadOffset   = NewFailResponse(0, "bad upload offset")
+)
+
+/*
+uploads tracks resumable upload sessions. Each session is a directory beneath
+the data base containing the bytes received so far and a JSON description of
+the image they will become, so an upload interrupted by a dropped connection
+or a restart can be resumed from wherever the data file ends.
+*/
+type uploads struct {
+	dir  string
+	lock sync.Mutex
+	busy map[string]bool
+}
+
+type uploadSession struct {
+	ID        string     `json:"id"`
+	Overwrite bool       `json:"overwrite"`
+	Length    int64      `json:"length"`
+	Created   int64      `json:"created"`
+	Data      uploadData `json:"data"`
+}
+
+type uploadPL struct {
+	ID     string `json:"id"`
+	Offset int64  `json:"offset"`
+	Length int64  `json:"length,omitempty"`
+}
+
+func (i *Images) setupUploads() error {
+	i.uploads.dir = i.s.conf.Base + "/uploads"
+	i.uploads.busy = make(map[string]bool)
+	err := os.MkdirAll(i.uploads.dir, 0755)
+	if err != nil {
+		return err
+	}
+	go i.expireUploads()
+	return nil
+}
+
+// expireUploads periodically removes upload sessions that have been
+// abandoned for longer than uploadExpiry.
+func (i *Images) expireUploads() {
+	ticker := time.NewTicker(time.Hour)
+	for {
+		infos, err := ioutil.ReadDir(i.uploads.dir)
+		if err != nil {
+			i.log.Error("couldn't list upload sessions", "error", err)
+		}
+		for _, info := range infos {
+			// the data file's modification time is the last activity
+			data, err := os.Stat(i.uploads.dataPath(info.Name()))
+			if err == nil && time.Since(data.ModTime()) < uploadExpiry {
+				continue
+			}
+			if !i.uploads.acquire(info.Name()) {
+				continue
+			}
+			os.RemoveAll(i.uploads.dir + "/" + info.Name())
+			i.uploads.release(info.Name())
+		}
+		<-ticker.C
+	}
+}
+
+func (u *uploads) acquire(id string) bool {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if u.busy[id] {
+		return false
+	}
+	u.busy[id] = true
+	return true
+}
+
+func (u *uploads) release(id string) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	delete(u.busy, id)
+}
+
+func (u *uploads) dataPath(id string) string {
+	return u.dir + "/" + id + "/data"
+}
+
+func (u *uploads) infoPath(id string) string {
+	return u.dir + "/" + id + "/info"
+}
+
+// size returns the number of bytes received so far for an upload, which is
+// the offset the next chunk must be written at.
+func (u *uploads) size(id string) (int64, error) {
+	info, err := os.Stat(u.dataPath(id))
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// create assigns a new session its ID and writes its info and an empty data
+// file to disk.
+func (u *uploads) create(sess *uploadSession) {
+	raw := make([]byte, uploadIDLen/2)
+	_, err := rand.Read(raw)
+	if err != nil {
+		panic(err)
+	}
+	sess.ID = hex.EncodeToString(raw)
+
+	err = os.Mkdir(u.dir+"/"+sess.ID, 0755)
+	if err != nil {
+		panic(err)
+	}
+	info, err := json.Marshal(sess)
+	if err != nil {
+		panic(err)
+	}
+	err = ioutil.WriteFile(u.infoPath(sess.ID), info, 0644)
+	if err != nil {
+		panic(err)
+	}
+	err = ioutil.WriteFile(u.dataPath(sess.ID), nil, 0644)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func validUploadID(id string) bool {
+	if len(id) != uploadIDLen {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+func (i *Images) uploadStart(s *Session, w http.ResponseWriter, r *http.Request) {
+	ul := i.makeUploadStruct(s, r)
+	if !strings.HasPrefix(ul.Target, "/images/") {
+		w.Write(ResponseAccessDenied.JSON())
+		return
+	}
+	sess := &uploadSession{
+		Overwrite: r.URL.Query().Get("overwrite") == "true",
+		Created:   time.Now().Unix(),
+		Data:      *ul,
+	}
+	if val := r.Header.Get("Upload-Length"); val != "" {
+		length, err := strconv.ParseInt(val, 10, 64)
+		if err != nil || length < 0 {
+			w.Write(NewFailResponse(0, "bad upload length").JSON())
+			return
+		}
+		sess.Length = length
+	}
+	if !i.s.data.quotaAllows(ul.Owner, ul.Group, sess.Length) {
+		w.Write(ResponseQuotaExceeded.JSON())
+		return
+	}
+
+	i.uploads.create(sess)
+
+	w.Write(NewSuccessResponse(&uploadPL{sess.ID, 0, sess.Length}).JSON())
+}
+
+// openUpload loads the upload session named in the request and marks it as
+// busy. It writes a failure response and returns nil if the session doesn't
+// exist, belongs to someone else, targets a different file or is already in
+// use. Callers must release the session when done.
+func (i *Images) openUpload(s *Session, w http.ResponseWriter, r *http.Request) *uploadSession {
+	id := r.URL.Query().Get("upload")
+	if !validUploadID(id) {
+		w.Write(ResponseUploadNotFound.JSON())
+		return nil
+	}
+	if !i.uploads.acquire(id) {
+		w.Write(ResponseUploadBusy.JSON())
+		return nil
+	}
+	info, err := ioutil.ReadFile(i.uploads.infoPath(id))
+	if err != nil {
+		i.uploads.release(id)
+		w.Write(ResponseUploadNotFound.JSON())
+		return nil
+	}
+	sess := new(uploadSession)
+	err = json.Unmarshal(info, sess)
+	if err != nil {
+		panic(err)
+	}
+	target := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, i.s.servicesVersionString()), "/")
+	if sess.Data.Owner != s.User.Name() || sess.Data.Target != target {
+		i.uploads.release(id)
+		w.Write(ResponseUploadNotFound.JSON())
+		return nil
+	}
+	return sess
+}
+
+func (i *Images) uploadProgress(s *Session, w http.ResponseWriter, r *http.Request) {
+	sess := i.openUpload(s, w, r)
+	if sess == nil {
+		return
+	}
+	defer i.uploads.release(sess.ID)
+
+	offset, err := i.uploads.size(sess.ID)
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	if sess.Length > 0 {
+		w.Header().Set("Upload-Length", strconv.FormatInt(sess.Length, 10))
+	}
+	w.Write(NewSuccessResponse(&uploadPL{sess.ID, offset, sess.Length}).JSON())
+}
+
+func (i *Images) uploadChunk(s *Session, w http.ResponseWriter, r *http.Request) {
+	sess := i.openUpload(s, w, r)
+	if sess == nil {
+		return
+	}
+	defer i.uploads.release(sess.ID)
+
+	size, err := i.uploads.size(sess.ID)
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(size, 10))
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset != size {
+		w.Write(ResponseUploadOffset.JSON())
+		return
+	}
+
+	var body io.Reader = r.Body
+	if sess.Length > 0 {
+		if r.ContentLength > sess.Length-offset {
+			w.Write(NewFailResponse(0, "chunk exceeds upload length").JSON())
+			return
+		}
+		body = io.LimitReader(r.Body, sess.Length-offset)
+	}
+
+	file, err := os.OpenFile(i.uploads.dataPath(sess.ID), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		panic(err)
+	}
+	_, err = io.Copy(file, body)
+	file.Close()
+	if err != nil {
+		i.log.Debug("upload chunk interrupted", "upload", sess.ID, "error", err)
+	}
+
+	// Whatever made it to disk is kept, so the client can resume from the
+	// new offset even if the chunk was cut short.
+	size, err = i.uploads.size(sess.ID)
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(size, 10))
+	w.Write(NewSuccessResponse(&uploadPL{sess.ID, size, sess.Length}).JSON())
+}
+
+func (i *Images) uploadFinish(s *Session, w http.ResponseWriter, r *http.Request) {
+	sess := i.openUpload(s, w, r)
+	if sess == nil {
+		return
+	}
+	defer i.uploads.release(sess.ID)
+
+	expected := strings.ToLower(r.URL.Query().Get("checksum"))
+	if expected == "" {
+		w.Write(NewFailResponse(0, "missing checksum").JSON())
+		return
+	}
+
+	file, err := os.Open(i.uploads.dataPath(sess.ID))
+	if err != nil {
+		panic(err)
+	}
+	sha := sha256.New()
+	size, err := io.Copy(sha, file)
+	file.Close()
+	if err != nil {
+		panic(err)
+	}
+	if sess.Length > 0 && size != sess.Length {
+		w.Write(NewFailResponse(0, "upload incomplete").JSON())
+		return
+	}
+	checksum := hex.EncodeToString(sha.Sum(nil))
+	if checksum != expected {
+		w.Write(NewFailResponse(0, "checksum mismatch").JSON())
+		return
+	}
+
+	meta := detectFormat(i.uploads.dataPath(sess.ID), size)
+	err = i.store(i.uploads.dataPath(sess.ID), checksum)
+	if err != nil {
+		panic(err)
+	}
+	os.RemoveAll(i.uploads.dir + "/" + sess.ID)
+
+	ul := &sess.Data
+	ul.Checksum = checksum
+	ul.Reserved = true
+	ul.Node = i.s.conf.Advertise
+	ul.Size = size
+	ul.Meta = meta
+	fn := "imagesUpload"
+	if sess.Overwrite {
+		fn = "imagesUploadOW"
+	}
+	i.commit(w, fn, ul)
+}
+
+func (i *Images) uploadAbort(s *Session, w http.ResponseWriter, r *http.Request) {
+	sess := i.openUpload(s, w, r)
+	if sess == nil {
+		return
+	}
+	defer i.uploads.release(sess.ID)
+
+	err := os.RemoveAll(i.uploads.dir + "/" + sess.ID)
+	if err != nil {
+		panic(err)
+	}
+	w.Write(NewSuccessResponse(nil).JSON())
+}